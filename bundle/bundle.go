@@ -0,0 +1,459 @@
+// Package bundle is how gproc moves a set of files as one stream: the
+// length of a gob-encoded list of entries, the list, and then the data
+// of the regular files one after the other in list order. It is the
+// takeout's shape, a file list up front and the data behind it, with
+// the list made self-contained so a bundle can be read on its own.
+//
+// Files come out as they went in: mode bits exactly, times, the
+// whitelisted xattrs, and owners where the extractor is asked to and
+// may. Setuid and setgid bits and file capabilities are only kept by an
+// extractor told the bundle came from root; from anyone else they would
+// be a way to get root's privileges on the node. A file with more than one link in
+// the bundle is sent once and linked again at the other names. A sparse
+// file sends only its data extents and gets its holes back at the other
+// end.
+package bundle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gob"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// An Extent is a run of data in a sparse file.
+type Extent struct {
+	Off, Len int64
+}
+
+// An Entry describes one file in a bundle.
+type Entry struct {
+	Name     string // relative to wherever the bundle is unpacked
+	Mode     uint32 // type and permission bits, as in stat
+	Size     int64
+	Mtime    int64 // ns
+	Link     string
+	HardLink string   // an earlier entry this is another name for; no data
+	Extents  []Extent // the data of a sparse file; nil if it has no holes
+	Xattrs   map[string][]byte
+	Uid      int
+	Gid      int
+	src      string // where the file is, if not under the base given Write
+	dev, ino uint64
+	nlink    uint64
+}
+
+func (e *Entry) IsDir() bool  { return e.Mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (e *Entry) IsLink() bool { return e.Mode&syscall.S_IFMT == syscall.S_IFLNK }
+func (e *Entry) IsReg() bool  { return e.Mode&syscall.S_IFMT == syscall.S_IFREG }
+
+// HasData says whether the entry has data in the stream.
+func (e *Entry) HasData() bool {
+	return e.IsReg() && e.HardLink == ""
+}
+
+// DataSize is how much of the stream the entry's data takes.
+func (e *Entry) DataSize() (n int64) {
+	if !e.HasData() {
+		return 0
+	}
+	if e.Extents == nil {
+		return e.Size
+	}
+	for _, x := range e.Extents {
+		n += x.Len
+	}
+	return
+}
+
+// Source is the file the entry was made from, if NewEntry made it.
+func (e *Entry) Source() string {
+	return e.src
+}
+
+// NewEntry describes the file at full, whose FileInfo is fi, for the
+// bundle as name.
+func NewEntry(name, full string, fi *os.FileInfo) (e Entry, err os.Error) {
+	e = Entry{
+		Name:  name,
+		Mode:  fi.Mode,
+		Mtime: fi.Mtime_ns,
+		Uid:   fi.Uid,
+		Gid:   fi.Gid,
+		src:   full,
+		dev:   fi.Dev,
+		ino:   fi.Ino,
+		nlink: fi.Nlink,
+	}
+	switch {
+	case fi.IsRegular():
+		e.Size = fi.Size
+		if fi.Blocks*512 < fi.Size {
+			e.Extents, err = dataExtents(full, fi.Size)
+			if err != nil {
+				return
+			}
+		}
+	case fi.IsSymlink():
+		e.Link, err = os.Readlink(full)
+		if err != nil {
+			return
+		}
+	}
+	e.Xattrs, err = getXattrs(full)
+	return
+}
+
+// Link finds the regular files that are links to ones earlier in the
+// list and marks them so. Write does it for the entries it is given.
+func Link(entries []Entry) {
+	type devino struct{ dev, ino uint64 }
+	first := make(map[devino]string)
+	for i := range entries {
+		e := &entries[i]
+		if !e.IsReg() || e.nlink < 2 || e.HardLink != "" {
+			continue
+		}
+		k := devino{e.dev, e.ino}
+		if n, ok := first[k]; ok {
+			e.HardLink = n
+			e.Extents = nil
+			continue
+		}
+		first[k] = e.Name
+	}
+}
+
+// WriteHeader writes v gob-encoded with its length in front.
+func WriteHeader(w io.Writer, v interface{}) (err os.Error) {
+	var hdr bytes.Buffer
+	err = gob.NewEncoder(&hdr).Encode(v)
+	if err != nil {
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, int64(hdr.Len()))
+	if err != nil {
+		return
+	}
+	_, err = w.Write(hdr.Bytes())
+	return
+}
+
+// MaxHeader is the longest header ReadHeader will take, a few million
+// files' worth.
+const MaxHeader = 1 << 30
+
+// ReadHeader reads what WriteHeader wrote and says how long it was.
+func ReadHeader(r io.Reader, v interface{}) (n int64, err os.Error) {
+	err = binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return
+	}
+	if n < 0 || n > MaxHeader {
+		return 0, os.NewError("bundle: bad header length")
+	}
+	hdr := make([]byte, n)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return
+	}
+	err = gob.NewDecoder(bytes.NewBuffer(hdr)).Decode(v)
+	return n + 8, err
+}
+
+// CopyData writes the entry's data, as it goes in the stream, from the
+// file name to w.
+func CopyData(w io.Writer, name string, e *Entry) (err os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if e.Extents == nil {
+		_, err = io.Copyn(w, f, e.Size)
+		return
+	}
+	for _, x := range e.Extents {
+		_, err = io.Copyn(w, io.NewSectionReader(f, x.Off, x.Len), x.Len)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Write writes a bundle of the entries, whose files are under base
+// unless NewEntry made them, to w.
+func Write(w io.Writer, base string, entries []Entry) (err os.Error) {
+	Link(entries)
+	err = WriteHeader(w, entries)
+	if err != nil {
+		return
+	}
+	for i := range entries {
+		e := &entries[i]
+		if !e.HasData() {
+			continue
+		}
+		name := e.src
+		if name == "" {
+			name = path.Join(base, e.Name)
+		}
+		err = CopyData(w, name, e)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Scan calls fn for each entry in the bundle, with the entry's data to
+// read if it has any. What fn leaves unread is skipped.
+func Scan(r io.Reader, fn func(e *Entry, data io.Reader) os.Error) (err os.Error) {
+	var entries []Entry
+	_, err = ReadHeader(r, &entries)
+	if err != nil {
+		return
+	}
+	for i := range entries {
+		e := &entries[i]
+		if !safeName(e.Name) || e.HardLink != "" && !safeName(e.HardLink) {
+			return os.NewError("bundle: bad name " + e.Name)
+		}
+		var data io.Reader
+		if e.HasData() {
+			data = io.LimitReader(r, e.DataSize())
+		}
+		err = fn(e, data)
+		if err != nil {
+			return
+		}
+		if data != nil {
+			_, err = io.Copy(discard{}, data)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// An Extractor makes the entries of a bundle under Base. The modes and
+// times of directories wait for Finish, so that a read-only directory
+// can still be filled and what goes in doesn't change its time.
+type Extractor struct {
+	Base       string
+	Owners     bool     // chown to the owners in the bundle
+	Privileged bool     // keep setuid and setgid bits and file capabilities
+	Files      []string // the regular files made, by entry name
+	dirs       []*Entry
+}
+
+// Extract unpacks the bundle under base and returns the names of the
+// regular files in it.
+func Extract(r io.Reader, base string) (files []string, err os.Error) {
+	x := &Extractor{Base: base}
+	err = x.Extract(r)
+	return x.Files, err
+}
+
+// Extract makes all the entries of the bundle read from r.
+func (x *Extractor) Extract(r io.Reader) (err os.Error) {
+	err = Scan(r, x.Entry)
+	if err != nil {
+		return
+	}
+	return x.Finish()
+}
+
+// Entry makes one entry, reading its data from data.
+func (x *Extractor) Entry(e *Entry, data io.Reader) (err os.Error) {
+	if !safeName(e.Name) || e.HardLink != "" && !safeName(e.HardLink) {
+		return os.NewError("bundle: bad name " + e.Name)
+	}
+	name := path.Join(x.Base, e.Name)
+	err = x.noLinks(e.Name)
+	if err == nil && e.HardLink != "" {
+		err = x.noLinks(e.HardLink)
+	}
+	if err != nil {
+		return
+	}
+	dir, _ := path.Split(name)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	// a symlink already there would have what follows go where it points
+	if fi, e := os.Lstat(name); e == nil && fi.IsSymlink() {
+		err = os.Remove(name)
+		if err != nil {
+			return
+		}
+	}
+	switch {
+	case e.IsDir():
+		err = os.MkdirAll(name, 0700)
+		if err != nil {
+			return
+		}
+		d := *e
+		x.dirs = append(x.dirs, &d)
+		return
+	case e.IsLink():
+		err = os.Symlink(e.Link, name)
+	case e.HardLink != "":
+		return os.Link(path.Join(x.Base, e.HardLink), name)
+	case e.IsReg():
+		err = writeData(name, e, data)
+		x.Files = append(x.Files, e.Name)
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+	return x.attrs(name, e)
+}
+
+// attrs sets what there is to set besides the data, in the order that
+// keeps each step from undoing the last: chown clears setuid bits and
+// capabilities, and anything at all changes the ctime.
+func (x *Extractor) attrs(name string, e *Entry) (err os.Error) {
+	if x.Owners {
+		os.Lchown(name, e.Uid, e.Gid)
+	}
+	if !e.IsLink() {
+		mode := e.Mode & 07777
+		if !x.Privileged && !e.IsDir() {
+			mode &^= syscall.S_ISUID | syscall.S_ISGID
+		}
+		err = os.Chmod(name, mode)
+		if err != nil {
+			return
+		}
+	}
+	for a, v := range e.Xattrs {
+		if a == capabilityXattr && !x.Privileged {
+			continue
+		}
+		// security.capability needs CAP_SETFCAP; say so, but go on
+		if err := setXattr(name, a, v); err != nil {
+			log.Printf("bundle: %v\n", err)
+		}
+	}
+	return lchtimes(name, e.Mtime)
+}
+
+// noLinks makes sure no directory on the way from the base to name is a
+// symlink, from the bundle or already there, so that an entry a -> /etc
+// followed by a/passwd can't put anything outside the base.
+func (x *Extractor) noLinks(name string) os.Error {
+	p := x.Base
+	dirs := strings.Split(name, "/", -1)
+	for _, d := range dirs[:len(dirs)-1] {
+		p = path.Join(p, d)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			// not made yet, so nothing under it is either
+			return nil
+		}
+		if fi.IsSymlink() {
+			return os.NewError("bundle: " + name + " is under a symlink")
+		}
+	}
+	return nil
+}
+
+// Finish sets the modes and times of the directories made.
+func (x *Extractor) Finish() (err os.Error) {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		e := x.dirs[i]
+		err = x.attrs(path.Join(x.Base, e.Name), e)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// writeData makes a regular file from the entry's data, holes and all.
+func writeData(name string, e *Entry, data io.Reader) (err os.Error) {
+	f, err := os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if e.Extents == nil {
+		_, err = io.Copyn(f, data, e.Size)
+		return
+	}
+	for _, x := range e.Extents {
+		_, err = f.Seek(x.Off, 0)
+		if err != nil {
+			return
+		}
+		_, err = io.Copyn(f, data, x.Len)
+		if err != nil {
+			return
+		}
+	}
+	return f.Truncate(e.Size)
+}
+
+// WriteDense writes the whole of a file from its data in the stream,
+// holes as zeros.
+func WriteDense(w io.Writer, e *Entry, data io.Reader) (err os.Error) {
+	if e.Extents == nil {
+		_, err = io.Copyn(w, data, e.Size)
+		return
+	}
+	zeros := make([]byte, 64<<10)
+	var off int64
+	hole := func(to int64) (err os.Error) {
+		for off < to {
+			n := int64(len(zeros))
+			if to-off < n {
+				n = to - off
+			}
+			_, err = w.Write(zeros[:n])
+			if err != nil {
+				return
+			}
+			off += n
+		}
+		return
+	}
+	for _, x := range e.Extents {
+		if err = hole(x.Off); err != nil {
+			return
+		}
+		if _, err = io.Copyn(w, data, x.Len); err != nil {
+			return
+		}
+		off += x.Len
+	}
+	return hole(e.Size)
+}
+
+// safeName keeps what is in a bundle inside the directory it goes to.
+func safeName(name string) bool {
+	if name == "" || name[0] == '/' {
+		return false
+	}
+	for _, s := range strings.Split(name, "/", -1) {
+		if s == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+type discard struct{}
+
+func (discard) Write(b []byte) (int, os.Error) { return len(b), nil }
@@ -0,0 +1,323 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// scratch makes a directory to work in, and a function to remove it.
+func scratch(t *testing.T) (dir string, clean func()) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// describe makes the entries for names under dir, in that order.
+func describe(t *testing.T, dir string, names ...string) (entries []Entry) {
+	for _, n := range names {
+		full := path.Join(dir, n)
+		fi, err := os.Lstat(full)
+		if err != nil {
+			t.Fatalf("Lstat: %v", err)
+		}
+		e, err := NewEntry(n, full, fi)
+		if err != nil {
+			t.Fatalf("NewEntry %s: %v", n, err)
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// roundTrip bundles the entries and extracts them under a new directory.
+func roundTrip(t *testing.T, entries []Entry, x *Extractor) {
+	var b bytes.Buffer
+	err := Write(&b, "", entries)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	err = x.Extract(&b)
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+}
+
+func write(t *testing.T, name, data string, mode uint32) {
+	err := ioutil.WriteFile(name, []byte(data), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(name, mode)
+}
+
+func lstat(t *testing.T, name string) *os.FileInfo {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	return fi
+}
+
+func TestHardLinks(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	src, dst := path.Join(dir, "src"), path.Join(dir, "dst")
+	os.Mkdir(src, 0755)
+	write(t, path.Join(src, "a"), "shared", 0644)
+	write(t, path.Join(src, "c"), "alone", 0644)
+	for _, n := range []string{"b", "d"} {
+		if err := os.Link(path.Join(src, "a"), path.Join(src, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := describe(t, src, "a", "b", "c", "d")
+	var b bytes.Buffer
+	if err := Write(&b, "", entries); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// one copy of the data, however many names
+	if n := strings.Count(b.String(), "shared"); n != 1 {
+		t.Errorf("data sent %d times", n)
+	}
+	x := &Extractor{Base: dst}
+	if err := x.Extract(&b); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	a := lstat(t, path.Join(dst, "a"))
+	for _, n := range []string{"b", "d"} {
+		fi := lstat(t, path.Join(dst, n))
+		if fi.Ino != a.Ino {
+			t.Errorf("%s is not a link to a", n)
+		}
+	}
+	if a.Nlink != 3 {
+		t.Errorf("a has %d links, want 3", a.Nlink)
+	}
+	if c := lstat(t, path.Join(dst, "c")); c.Ino == a.Ino {
+		t.Error("c is linked to a")
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dst, "d")); string(data) != "shared" {
+		t.Errorf("d has %q", data)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	src, dst := path.Join(dir, "src"), path.Join(dir, "dst")
+	os.Mkdir(src, 0755)
+	const size = 4 << 20
+	f, err := os.Open(path.Join(src, "sparse"), os.O_WRONLY|os.O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("in the middle"), 1<<20)
+	f.Truncate(size)
+	f.Close()
+	entries := describe(t, src, "sparse")
+	if entries[0].Extents == nil {
+		t.Log("file system doesn't report holes; skipped")
+		return
+	}
+	if entries[0].DataSize() >= size {
+		t.Errorf("sends %d bytes of a sparse file", entries[0].DataSize())
+	}
+	roundTrip(t, entries, &Extractor{Base: dst})
+
+	name := path.Join(dst, "sparse")
+	fi := lstat(t, name)
+	if fi.Size != size {
+		t.Errorf("size %d, want %d", fi.Size, size)
+	}
+	f, err = os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if off, e := syscall.Seek(f.Fd(), 0, seekHole); e != 0 || off != 0 {
+		t.Errorf("SEEK_HOLE from 0 gives %d, %d; want a hole at 0", off, e)
+	}
+	if off, e := syscall.Seek(f.Fd(), 0, seekData); e != 0 || off > 1<<20 {
+		t.Errorf("SEEK_DATA from 0 gives %d, %d; want the data by 1M", off, e)
+	}
+	b := make([]byte, 13)
+	f.ReadAt(b, 1<<20)
+	if string(b) != "in the middle" {
+		t.Errorf("data at 1M is %q", b)
+	}
+}
+
+func TestModes(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	src := path.Join(dir, "src")
+	os.Mkdir(src, 0755)
+	modes := map[string]uint32{"plain": 0640, "exec": 0751, "setuid": 04755, "setgid": 02710, "sticky": 01777}
+	var names []string
+	for n, m := range modes {
+		write(t, path.Join(src, n), n, m)
+		names = append(names, n)
+	}
+	os.Mkdir(path.Join(src, "ro"), 0555)
+	names = append(names, "ro")
+	entries := describe(t, src, names...)
+
+	for _, privileged := range []bool{false, true} {
+		dst := path.Join(dir, "dst")
+		os.RemoveAll(dst)
+		roundTrip(t, entries, &Extractor{Base: dst, Privileged: privileged})
+		for n, m := range modes {
+			want := m
+			if !privileged {
+				want &^= syscall.S_ISUID | syscall.S_ISGID
+			}
+			if got := lstat(t, path.Join(dst, n)).Mode & 07777; got != want {
+				t.Errorf("privileged %v: %s has mode %o, want %o", privileged, n, got, want)
+			}
+		}
+		if got := lstat(t, path.Join(dst, "ro")).Mode & 07777; got != 0555 {
+			t.Errorf("ro has mode %o, want 555", got)
+		}
+		os.Chmod(path.Join(dst, "ro"), 0755)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	src, dst := path.Join(dir, "src"), path.Join(dir, "dst")
+	os.MkdirAll(path.Join(src, "d"), 0755)
+	write(t, path.Join(src, "d", "f"), "data", 0644)
+	if err := os.Symlink("f", path.Join(src, "d", "l")); err != nil {
+		t.Fatal(err)
+	}
+	times := map[string]int64{
+		"d":   1000000000e9,
+		"d/f": 1100000000e9 + 123456789,
+		"d/l": 1200000000e9,
+	}
+	for n, ns := range times {
+		if err := lchtimes(path.Join(src, n), ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the directory first, as a walk finds it, so its time has to
+	// survive what is made in it after
+	roundTrip(t, describe(t, src, "d", "d/f", "d/l"), &Extractor{Base: dst})
+	for n, ns := range times {
+		if got := lstat(t, path.Join(dst, n)).Mtime_ns; got != ns {
+			t.Errorf("%s has mtime %d, want %d", n, got, ns)
+		}
+	}
+	if l, _ := os.Readlink(path.Join(dst, "d", "l")); l != "f" {
+		t.Errorf("d/l points to %q", l)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	src, dst := path.Join(dir, "src"), path.Join(dir, "dst")
+	os.Mkdir(src, 0755)
+	name := path.Join(src, "f")
+	write(t, name, "data", 0644)
+	big := bytes.Repeat([]byte("x"), 3000)
+	attrs := map[string][]byte{
+		"user.small": []byte("value"),
+		"user.big":   big,
+		"user.empty": []byte{},
+	}
+	for a, v := range attrs {
+		if err := setXattr(name, a, v); err != nil {
+			t.Logf("file system won't take %s (%v); skipped", a, err)
+			return
+		}
+	}
+	// enough names that the list won't fit the usual buffer
+	for i := 0; i < 200; i++ {
+		a := "user." + strings.Repeat("n", 30) + string('a'+i%26) + string('a'+i/26)
+		if err := setXattr(name, a, nil); err != nil {
+			break
+		}
+		attrs[a] = []byte{}
+	}
+	entries := describe(t, src, "f")
+	if len(entries[0].Xattrs) != len(attrs) {
+		t.Errorf("read %d xattrs, want %d", len(entries[0].Xattrs), len(attrs))
+	}
+	roundTrip(t, entries, &Extractor{Base: dst})
+	got, err := getXattrs(path.Join(dst, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a, v := range attrs {
+		if !bytes.Equal(got[a], v) {
+			t.Errorf("%s: got %d bytes, want %d", a, len(got[a]), len(v))
+		}
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	src, dst, outside := path.Join(dir, "src"), path.Join(dir, "dst"), path.Join(dir, "outside")
+	os.Mkdir(src, 0755)
+	os.Mkdir(outside, 0755)
+	if err := os.Symlink(outside, path.Join(src, "a")); err != nil {
+		t.Fatal(err)
+	}
+	entries := describe(t, src, "a")
+	os.Remove(path.Join(src, "a"))
+	os.Mkdir(path.Join(src, "a"), 0755)
+	write(t, path.Join(src, "a", "passwd"), "pwned", 0644)
+	entries = append(entries, describe(t, src, "a/passwd")...)
+
+	var b bytes.Buffer
+	if err := Write(&b, "", entries); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := (&Extractor{Base: dst}).Extract(&b); err == nil {
+		t.Error("extracted a file under a symlink")
+	}
+	if _, err := os.Lstat(path.Join(outside, "passwd")); err == nil {
+		t.Error("wrote outside the base")
+	}
+}
+
+func TestBadNames(t *testing.T) {
+	dir, clean := scratch(t)
+	defer clean()
+	x := &Extractor{Base: path.Join(dir, "dst")}
+	for _, e := range []Entry{
+		{Name: "../escape", Mode: syscall.S_IFDIR | 0755},
+		{Name: "/abs", Mode: syscall.S_IFDIR | 0755},
+		{Name: "a/../../escape", Mode: syscall.S_IFDIR | 0755},
+		{Name: "ok", Mode: syscall.S_IFREG | 0644, HardLink: "../../etc/passwd"},
+	} {
+		if err := x.Entry(&e, nil); err == nil {
+			t.Errorf("made %s", e.Name)
+		}
+	}
+	if _, err := os.Lstat(path.Join(dir, "escape")); err == nil {
+		t.Error("made a directory outside the base")
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	var v []Entry
+	for _, n := range []int64{-1, MaxHeader + 1} {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, n)
+		if _, err := ReadHeader(&b, &v); err == nil {
+			t.Errorf("took a header of length %d", n)
+		}
+	}
+}
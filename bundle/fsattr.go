@@ -0,0 +1,155 @@
+package bundle
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// File attributes that os doesn't get at: extended attributes, the
+// data and holes of sparse files, and times on symlinks.
+
+// Only these xattrs travel; security.capability is what lets ping-like
+// tools work without being setuid.
+var xattrWhitelist = []string{capabilityXattr, "user."}
+
+const capabilityXattr = "security.capability"
+
+const (
+	seekData          = 3
+	seekHole          = 4
+	atFdcwd           = -100
+	atSymlinkNofollow = 0x100
+)
+
+func xattrWanted(name string) bool {
+	for _, w := range xattrWhitelist {
+		if name == w || strings.HasSuffix(w, ".") && strings.HasPrefix(name, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func cstring(s string) *byte {
+	b := make([]byte, len(s)+1)
+	copy(b, s)
+	return &b[0]
+}
+
+// getXattrs reads the whitelisted xattrs of name, not following symlinks.
+func getXattrs(name string) (x map[string][]byte, err os.Error) {
+	cname := uintptr(unsafe.Pointer(cstring(name)))
+	list, e := xattrBuf(func(p, n uintptr) (uintptr, uintptr, uintptr) {
+		return syscall.Syscall(syscall.SYS_LLISTXATTR, cname, p, n)
+	})
+	switch {
+	case e == syscall.ENOTSUP || e == syscall.ENOSYS:
+		return nil, nil
+	case e != 0:
+		return nil, &os.PathError{"llistxattr", name, os.Errno(e)}
+	}
+	for _, a := range bytes.Split(list, []byte{0}, -1) {
+		attr := string(a)
+		if attr == "" || !xattrWanted(attr) {
+			continue
+		}
+		cattr := uintptr(unsafe.Pointer(cstring(attr)))
+		v, e := xattrBuf(func(p, n uintptr) (uintptr, uintptr, uintptr) {
+			return syscall.Syscall6(syscall.SYS_LGETXATTR, cname, cattr, p, n, 0, 0)
+		})
+		if e == syscall.ENODATA {
+			continue // gone since the list
+		}
+		if e != 0 {
+			return nil, &os.PathError{"lgetxattr " + attr, name, os.Errno(e)}
+		}
+		if x == nil {
+			x = make(map[string][]byte)
+		}
+		x[attr] = v
+	}
+	return
+}
+
+// xattrBuf makes a listxattr or getxattr style call with a buffer as big
+// as the kernel says it needs to be, and again with a bigger one if what
+// there is grows in between.
+func xattrBuf(call func(p, n uintptr) (uintptr, uintptr, uintptr)) (b []byte, e uintptr) {
+	for {
+		n, _, e := call(0, 0)
+		if e != 0 || n == 0 {
+			return nil, e
+		}
+		b = make([]byte, n)
+		m, _, e := call(uintptr(unsafe.Pointer(&b[0])), n)
+		if e == syscall.ERANGE {
+			continue
+		}
+		if e != 0 {
+			return nil, e
+		}
+		return b[:m], 0
+	}
+	panic("unreachable")
+}
+
+func setXattr(name, attr string, v []byte) os.Error {
+	var p uintptr
+	if len(v) > 0 {
+		p = uintptr(unsafe.Pointer(&v[0]))
+	}
+	_, _, e := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(cstring(name))),
+		uintptr(unsafe.Pointer(cstring(attr))), p, uintptr(len(v)), 0, 0)
+	if e != 0 {
+		return &os.PathError{"lsetxattr " + attr, name, os.Errno(e)}
+	}
+	return nil
+}
+
+// dataExtents finds the parts of a file that aren't holes. It returns
+// nil for a file without holes, and for file systems that can't say.
+func dataExtents(name string, size int64) (ext []Extent, err os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var off int64
+	for off < size {
+		start, e := syscall.Seek(f.Fd(), off, seekData)
+		if e == syscall.ENXIO {
+			break // nothing but hole from here
+		}
+		if e != 0 {
+			return nil, nil
+		}
+		end, e := syscall.Seek(f.Fd(), start, seekHole)
+		if e != 0 {
+			return nil, nil
+		}
+		ext = append(ext, Extent{start, end - start})
+		off = end
+	}
+	if len(ext) == 1 && ext[0].Off == 0 && ext[0].Len == size {
+		return nil, nil
+	}
+	if ext == nil {
+		// all hole; an empty list would read as no holes at all
+		ext = []Extent{{size, 0}}
+	}
+	return
+}
+
+// lchtimes sets the times of name without following a symlink.
+func lchtimes(name string, mtime int64) os.Error {
+	ts := [2]syscall.Timespec{syscall.NsecToTimespec(mtime), syscall.NsecToTimespec(mtime)}
+	_, _, e := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFdcwd), uintptr(unsafe.Pointer(cstring(name))),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if e != 0 {
+		return &os.PathError{"utimensat", name, os.Errno(e)}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package bundle
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+)
+
+// Tar rewrites a bundle as a tar file. Sparse files go in dense.
+func Tar(r io.Reader, w io.Writer) (err os.Error) {
+	tw := tar.NewWriter(w)
+	err = Scan(r, func(e *Entry, data io.Reader) (err os.Error) {
+		h := &tar.Header{Name: e.Name, Mode: int64(e.Mode & 07777), Mtime: e.Mtime / 1e9}
+		switch {
+		case e.IsDir():
+			h.Typeflag = tar.TypeDir
+		case e.IsLink():
+			h.Typeflag = tar.TypeSymlink
+			h.Linkname = e.Link
+		case e.HardLink != "":
+			h.Typeflag = tar.TypeLink
+			h.Linkname = e.HardLink
+		case e.IsReg():
+			h.Typeflag = tar.TypeReg
+			h.Size = e.Size
+		default:
+			return
+		}
+		err = tw.WriteHeader(h)
+		if err == nil && data != nil {
+			err = WriteDense(tw, e, data)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	return tw.Close()
+}
@@ -5,15 +5,18 @@ package cluster
 import (
 	"os"
 	"gob"
+	"syscall"
+	"gproc-npe.googlecode.com/hg/context"
 	"gproc-npe.googlecode.com/hg/worker"
 )
 // RUN
 // read a set of arguments from stdin
 // make a directory at pathbase
 // if we should make the mount private
-// 	unshare
+// 	(we were cloned into our own mount namespace)
+// 	stop mounts propagating out
 // 	unmount the pathbase
-// 	and private mount the pathbase
+// 	and mount a tmpfs on the pathbase
 // for all the commands we get from the arg
 // 	write them out
 // connect the server 
@@ -35,14 +38,12 @@ func makeProcessDirs(pathbase string) (err os.Error) {
 		return
 	}
 	if DoPrivateMount == true {
-		unshare()
-		err = unmount(pathbase)
-		if err != nil {
-			return
+		if e := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); e != 0 {
+			return os.Errno(e)
 		}
-		err = privatemount(pathbase)
-		if err != nil {
-			return
+		syscall.Unmount(pathbase, syscall.MNT_DETACH)
+		if e := syscall.Mount("xproc", pathbase, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0700"); e != 0 {
+			return os.Errno(e)
 		}
 	}
 	return
@@ -127,7 +128,7 @@ func Run() (err os.Error) {
 
 // RunWorkers distributes work to workers based on a StartArgs list.
 func RunWorkers(fam, addr string, args StartArgs) (err os.Error) {
-	c, err := networker.NewClient(fam, addr, args)
+	c, err := worker.NewClient(context.Background(), fam, addr, args, 0)
 	if err != nil {
 		return
 	}
@@ -166,39 +167,9 @@ func collectFileData()  (err os.Error) {
 func RunMaster() (err os.Error){
 	makeLocalSocket()
 	collectFileData()
-	w, err := worker.NewWorker("unix", "0.0.0.0:0")
+	w, err := worker.NewWorker(context.Background(), "unix", "0.0.0.0:0")
 	if err != nil {
 		return
 	}
 	makeSlave()
 }
-
-
-
-// EXEC
-// get a list of stuff you need to takeout
-// get the library path
-// and load everything in your command file and your library path
-// make workers for everything in the nodelist
-// also get peers
-// send arguments
-// for all of the files copy them to the clients
-// wait for your workers to complete
-
-// Exec gets a list of files to send to worker nodes and peer nodes, sends
-// arguments to the worker, then sends the files and waits for the worker to
-// complete
-func  Exec() (err os.Error) {
-	// EXEC
-	// get a list of stuff you need to takeout
-	// get the library path
-	// and load everything in your command file and your library path
-	// make workers for everything in the nodelist
-	// also get peers
-	// send arguments
-	// for all of the files copy them to the clients
-	// wait for your workers to complete
-}
-
-
-
@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"netchan"
+	"os"
+	"strconv"
+)
+
+// Output from the remote processes comes back as IoData: which node and
+// rank it came from, which of its descriptors, and the bytes. Src is
+// what the client labels and groups output by: the node, or node.rank
+// when a node runs more than one process of the job. The runner does
+// the line buffering, so unless the job is raw every message holds
+// whole lines and output from different nodes never gets mixed up
+// mid-line at the client. An empty Data is EOF on that descriptor, and
+// an empty Data with Fd 0 the end of all of the node's output: the
+// runner sends it after everything else, and before its NodeStatus,
+// which comes on a channel of its own and can get there first.
+type IoData struct {
+	JobId int
+	Node  string
+	Rank  int
+	Src   string
+	Host  string
+	Fd    int
+	Data  []byte
+}
+
+// A NodeStatus is what a node's runner reports on the status channel
+// when the job is done there, with Done set. Job.Status gives one for
+// every node, with Done clear for those still going. If the node had the
+// job in a cgroup, MemPeak and CpuUsec say how much it used there.
+type NodeStatus struct {
+	Node    string
+	Status  int
+	Done    bool
+	MemPeak int64 // bytes
+	CpuUsec int64
+}
+
+// StatusTimedOut is the status of a job that ran out of time, what
+// timeout(1) exits with.
+const StatusTimedOut = 124
+
+// The client's stdin goes to the remote processes according to the
+// job's stdin mode:
+//	none	nobody gets it; the remote processes read /dev/null
+//	rank0	it all goes to the process of rank 0
+//	all	every process gets its own copy
+//	scatter	newline-delimited records are dealt out by rank,
+//		record i going to rank i modulo the number of processes
+// Each rank gets its own channel, named for the rank, since a netchan
+// hands each value to just one of its importers. EOF is an empty
+// message rather than a closed channel so that anything relaying it on
+// down the tree passes it along like any other message.
+
+// StdinChan is the name of the channel rank's stdin comes on.
+func StdinChan(rank int) string {
+	return "stdin/" + strconv.Itoa(rank)
+}
+
+// StdinWanted says whether a rank in a job gets any stdin at all.
+func StdinWanted(mode string, rank int) bool {
+	switch mode {
+	case "all", "scatter":
+		return true
+	case "rank0":
+		return rank == 0
+	}
+	return false
+}
+
+func checkStdin(mode string) os.Error {
+	switch mode {
+	case "", "none", "rank0", "all", "scatter":
+		return nil
+	}
+	return os.NewError("unknown -stdin mode " + mode)
+}
+
+// stdinexport makes the per-rank stdin channels and starts feeding
+// them from in.
+func stdinexport(exp *netchan.Exporter, in io.Reader, mode string, size int) (err os.Error) {
+	if mode == "" || mode == "none" {
+		return
+	}
+	var chans []chan IoData
+	for r := 0; r < size; r++ {
+		if !StdinWanted(mode, r) {
+			continue
+		}
+		c := make(chan IoData)
+		err = exp.Export(StdinChan(r), c, netchan.Send)
+		if err != nil {
+			return
+		}
+		chans = append(chans, c)
+	}
+	if mode == "scatter" {
+		go scatter(in, chans)
+	} else {
+		go broadcast(in, chans)
+	}
+	return
+}
+
+func broadcast(in io.Reader, chans []chan IoData) {
+	for {
+		b := make([]byte, 8192)
+		n, err := in.Read(b)
+		if n > 0 {
+			for _, c := range chans {
+				c <- IoData{Fd: 0, Data: b[:n]}
+			}
+		}
+		if err != nil {
+			if err != os.EOF {
+				log.Printf("stdin: %v\n", err)
+			}
+			break
+		}
+	}
+	for _, c := range chans {
+		c <- IoData{Fd: 0}
+	}
+}
+
+func scatter(in io.Reader, chans []chan IoData) {
+	r := bufio.NewReader(in)
+	for i := 0; ; i++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			chans[i%len(chans)] <- IoData{Fd: 0, Data: line}
+		}
+		if err != nil {
+			if err != os.EOF {
+				log.Printf("stdin: %v\n", err)
+			}
+			break
+		}
+	}
+	for _, c := range chans {
+		c <- IoData{Fd: 0}
+	}
+}
@@ -0,0 +1,323 @@
+package cluster
+
+import (
+	"bytes"
+	"gob"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/context"
+)
+
+// A Job is a job Launch started.
+type Job struct {
+	Id     int
+	Nodes  []string
+	master string
+
+	lock   sync.Mutex
+	status map[string]NodeStatus
+	result int
+	err    os.Error
+	done   chan bool
+
+	out      func(d IoData)
+	streams  [3]*stream
+	ended    map[string]bool // nodes that have sent all their output
+	failed   map[string]bool // nodes the master couldn't start
+	endc     chan bool       // another has
+	stage    *stageCollector
+	term     *syscall.Termios
+	deadline int64 // seconds to wait for the nodes at all; 0 for ever
+
+	listener *listener // where the nodes reach us
+	quit     chan bool // closed to stop what serves them
+}
+
+func newJob(master string, spec *JobSpec) *Job {
+	j := &Job{
+		Nodes:  spec.Nodes,
+		master: master,
+		status: make(map[string]NodeStatus),
+		done:   make(chan bool),
+		out:    spec.IO.Output,
+		ended:  make(map[string]bool),
+		failed: make(map[string]bool),
+		endc:   make(chan bool, 1),
+		quit:   make(chan bool),
+	}
+	j.streams[1] = newStream()
+	j.streams[2] = newStream()
+	// the master and the runners enforce the time limit; this is
+	// only so we don't wait forever on nodes that never answer at all
+	if spec.TimeLimit > 0 {
+		j.deadline = spec.LaunchTimeout + spec.TimeLimit + 2*spec.Grace + 10
+	}
+	return j
+}
+
+// Stdout is what the job's processes write to their standard output,
+// from all the nodes as it comes, unless the IOSpec had an Output. It
+// holds on to whatever hasn't been read yet, and ends with the job.
+func (j *Job) Stdout() io.Reader {
+	return j.streams[1]
+}
+
+// Stderr is Stdout for standard error.
+func (j *Job) Stderr() io.Reader {
+	return j.streams[2]
+}
+
+// Status says how the job has ended on each node, in the order of
+// Nodes. A node still going has Done clear.
+func (j *Job) Status() []NodeStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	s := make([]NodeStatus, len(j.Nodes))
+	for i, n := range j.Nodes {
+		s[i] = j.status[n]
+		s[i].Node = n
+	}
+	return s
+}
+
+// Wait waits for the job to end on every node and returns its status:
+// the first non-zero status of a node, or StatusTimedOut if it ran out
+// of time anywhere. err is set if the job was given up on.
+func (j *Job) Wait() (status int, err os.Error) {
+	<-j.done
+	return j.result, j.err
+}
+
+// ctlArg and ctlRes are the gproc command's CtlArg and CtlRes, as far
+// as kill goes.
+type ctlArg struct {
+	Cmd   string
+	JobId int
+	Node  string
+	Sig   int
+}
+
+type ctlRes struct {
+	Msg []byte
+	Err string
+}
+
+// Signal sends sig to the job's processes on every node.
+func (j *Job) Signal(sig int) (err os.Error) {
+	c, err := net.Dial("unix", "", j.master+".ctl")
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	err = gob.NewEncoder(c).Encode(ctlArg{Cmd: "kill", JobId: j.Id, Sig: sig})
+	if err != nil {
+		return
+	}
+	var r ctlRes
+	err = gob.NewDecoder(c).Decode(&r)
+	if err == nil && r.Err != "" {
+		err = os.NewError(r.Err)
+	}
+	return
+}
+
+// output hands out what comes back from the processes, until the job
+// is released.
+func (j *Job) output(wchan chan IoData) {
+	for {
+		var d IoData
+		select {
+		case d = <-wchan:
+		case <-j.quit:
+			return
+		}
+		if len(d.Data) == 0 {
+			if d.Fd == 0 {
+				j.lock.Lock()
+				j.ended[d.Node] = true
+				j.lock.Unlock()
+				select {
+				case j.endc <- true:
+				default:
+				}
+			}
+			continue
+		}
+		switch {
+		case j.out != nil:
+			j.out(d)
+		case d.Fd == 1 || d.Fd == 2:
+			j.streams[d.Fd].Write(d.Data)
+		}
+	}
+}
+
+// fail marks the nodes the master couldn't start the job on as done,
+// with status -1. Nothing will come from them.
+func (j *Job) fail(nodes []string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, n := range nodes {
+		j.status[n] = NodeStatus{Node: n, Status: -1, Done: true}
+		j.ended[n] = true
+		j.failed[n] = true
+		if j.result == 0 {
+			j.result = -1
+		}
+	}
+}
+
+// wait collects the status of each node, and the stage-out, and gives
+// up on nodes that don't answer in time.
+func (j *Job) wait(ctx context.Context, schan chan NodeStatus) {
+	var deadline <-chan int64
+	if j.deadline > 0 {
+		deadline = time.After(j.deadline * 1e9)
+	}
+	ctxdone := ctx.Done()
+	j.lock.Lock()
+	left := len(j.Nodes) - len(j.failed)
+	j.lock.Unlock()
+	for left > 0 {
+		select {
+		case s := <-schan:
+			s.Done = true
+			j.lock.Lock()
+			if j.status[s.Node].Done {
+				// one the master gave up on, or said twice
+				j.lock.Unlock()
+				continue
+			}
+			j.status[s.Node] = s
+			if s.Status != 0 && j.result != StatusTimedOut {
+				j.result = s.Status
+			}
+			j.lock.Unlock()
+			left--
+		case <-ctxdone:
+			j.err = ctx.Err()
+			if err := j.Signal(syscall.SIGKILL); err != nil {
+				log.Printf("job %d: %v\n", j.Id, err)
+			}
+			// it should go quickly now; don't wait long if not
+			ctxdone = nil
+			deadline = time.After(30e9)
+		case <-deadline:
+			log.Printf("job %d timed out, %d nodes never reported\n", j.Id, left)
+			j.result = StatusTimedOut
+			left = 0
+		}
+	}
+	if j.err == nil {
+		// the runners send these before their status, but on channels
+		// of their own, so they may still be on the way
+		j.waitOutput(30)
+		if j.stage != nil {
+			var nodes []string
+			for _, n := range j.Nodes {
+				if !j.failed[n] {
+					nodes = append(nodes, n)
+				}
+			}
+			j.stage.wait(nodes, 30)
+		}
+	}
+	j.release()
+	j.streams[1].Close()
+	j.streams[2].Close()
+	close(j.done)
+}
+
+// waitOutput waits for the end of the output of each node that has
+// reported, for at most timeout seconds in all.
+func (j *Job) waitOutput(timeout int64) {
+	deadline := time.After(timeout * 1e9)
+	for {
+		j.lock.Lock()
+		var missing []string
+		for _, n := range j.Nodes {
+			if j.status[n].Done && !j.ended[n] {
+				missing = append(missing, n)
+			}
+		}
+		j.lock.Unlock()
+		if len(missing) == 0 {
+			return
+		}
+		select {
+		case <-j.endc:
+		case <-deadline:
+			log.Printf("output from %s may be cut short\n", strings.Join(missing, ","))
+			return
+		}
+	}
+}
+
+// release lets go of what Launch set up for the job: the listener the
+// nodes reach back to and their connections, and what serves them. The
+// terminal goes back the way it was.
+func (j *Job) release() {
+	j.restore()
+	close(j.quit)
+	if j.listener != nil {
+		j.listener.Close()
+	}
+}
+
+// restore puts the terminal back the way it was before a tty job.
+func (j *Job) restore() {
+	if j.term != nil {
+		restoreTerm(0, *j.term)
+		j.term = nil
+	}
+}
+
+// A stream holds output until it is read, however much there is, so
+// that a reader that falls behind never holds up the job.
+type stream struct {
+	lock   sync.Mutex
+	more   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newStream() *stream {
+	s := new(stream)
+	s.more = sync.NewCond(&s.lock)
+	return s
+}
+
+func (s *stream) Write(b []byte) (int, os.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf.Write(b)
+	s.more.Broadcast()
+	return len(b), nil
+}
+
+func (s *stream) Read(b []byte) (n int, err os.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buf.Len() == 0 && !s.closed {
+		s.more.Wait()
+	}
+	if s.buf.Len() == 0 {
+		return 0, os.EOF
+	}
+	return s.buf.Read(b)
+}
+
+func (s *stream) Close() os.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.more.Broadcast()
+	return nil
+}
@@ -0,0 +1,531 @@
+package cluster
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"netchan"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+	"gproc-npe.googlecode.com/hg/context"
+)
+
+// A Launcher starts jobs through a gproc master. It is what
+// `gproc e` does, for programs that would rather not run gproc:
+//
+//	l := &cluster.Launcher{Master: "/tmp/g", Fam: "tcp4", Addr: "10.0.0.1:0"}
+//	j, err := l.Launch(context.Background(), cluster.JobSpec{
+//		Args:  []string{"/bin/date"},
+//		Nodes: []string{"1", "2", "3"},
+//	})
+//	...
+//	status, err := j.Wait()
+type Launcher struct {
+	Master string // the master's unix socket
+	Fam    string // how the job's nodes reach back to us, as for netchan
+	Addr   string // and where; port 0 picks one
+}
+
+// Limits are the cgroup limits on the job on each node. Zero is no limit.
+type Limits struct {
+	MemMax   int64   // memory.max, bytes
+	Cpus     float64 // cpu.max, in cpus' worth of time
+	PidsMax  int     // pids.max
+	IoWeight int     // io.weight, 1 to 10000
+}
+
+// Any says whether there are any limits at all.
+func (l *Limits) Any() bool {
+	return l.MemMax > 0 || l.Cpus > 0 || l.PidsMax > 0 || l.IoWeight > 0
+}
+
+// Check says what is wrong with the limits, if anything.
+func (l *Limits) Check() os.Error {
+	if l.IoWeight != 0 && (l.IoWeight < 1 || l.IoWeight > 10000) {
+		return os.NewError("-ioweight must be between 1 and 10000")
+	}
+	if l.MemMax < 0 || l.Cpus < 0 || l.PidsMax < 0 {
+		return os.NewError("limits can't be negative")
+	}
+	return nil
+}
+
+// An Rlimit is a resource limit for the job's processes, by the name
+// setrlimit gives it less the RLIMIT_, in lower case.
+type Rlimit struct {
+	Name     string
+	Cur, Max uint64
+}
+
+// Takeout is what files go along with the job. They turn up on the
+// nodes at the same paths they have here.
+type Takeout struct {
+	Files    []string          // files and directory trees to take
+	Entries  []bundle.Entry    // files already described, as discovery finds them
+	Bundle   []byte            // a bundle made already, as from a pack; nothing else is taken
+	LocalBin bool              // the command is on the nodes already
+	Lazy     bool              // serve the files over 9P as they are opened instead
+	Prefetch []string          // with Lazy, files to fetch before the job starts
+	Hide     func(string) bool // files to leave behind even though asked for
+}
+
+// IOSpec is where the job's input and output go.
+type IOSpec struct {
+	Stdin     io.Reader // read by the ranks StdinMode says
+	StdinMode string    // none, rank0, all or scatter; see StdinChan
+	Tty       bool      // one process on a pty, with this process's terminal
+	Raw       bool      // relay output as it comes, not a line at a time
+
+	// Output, if set, gets everything the processes write, and
+	// Job.Stdout and Job.Stderr get nothing.
+	Output func(d IoData)
+
+	// StdoutFile and StderrFile have each node write its output to
+	// a file named by the template (%j job, %n node, %r rank, %h
+	// host) in its stage-out directory, which comes back with
+	// the rest of the stage-out.
+	StdoutFile, StderrFile string
+
+	StageOut    []string // patterns of files in the job directory to bring back
+	StageOutMax int64    // the most stage-out to take from each node; 0 for DefaultStageOutMax
+	StageDir    string   // where stage-out goes, under <jobid>/; default .
+	StageTar    bool     // write each node's stage-out as <node>.tar
+}
+
+// A JobSpec is what to run and how.
+type JobSpec struct {
+	Args           []string // the command and its arguments
+	Env            []string // KEY=VAL for the processes
+	EnvTemplates   []string // KEY=VAL with %j, %n, %r and %h expanded per rank
+	Nodes          []string
+	Np, Ppn        int    // processes in all and per node; see RankMap
+	Dist           string // block or cyclic
+	Bind           string // none, core or socket
+	HostfileFormat string // plain, mpich or openmpi
+	Namespaces     string // besides mount: any of ipc, uts, pid, net
+	Hostname       string // in the uts namespace, a template as for Env
+	Root           string // "", overlay or bind
+	Headroom       int64  // bytes beyond the files in the job's tmpfs
+
+	Takeout Takeout
+	Limits  Limits
+	Rlimits []Rlimit
+
+	TimeLimit     int64 // seconds the job may run; 0 for no limit
+	Grace         int64 // seconds between SIGTERM and SIGKILL when it is up
+	LaunchTimeout int64 // seconds to get the files to each node and start
+
+	Nice             int
+	IoClass, IoLevel int // as for ioprio_set
+	Policy, Priority int // as for sched_setscheduler
+
+	IO IOSpec
+}
+
+// A StartArg is what a job is started with on each node. The client
+// fills in what it asks for, and the master and the slaves the rest on
+// the way: JobId, JobFiles, Provided, NodeId, MasterFam and MasterAddr,
+// and Cgroup. Uid and Gid are whoever is on the other end of the
+// master's socket; the client has no say in them.
+type StartArg struct {
+	Nodes          []string // nodes that have contacted you
+	Peers          []string // addr/port strings to exec build the ad-hoc tree
+	ThisNode       bool
+	LocalBin       bool
+	RawIO          bool
+	NodeRedirect   bool
+	Stdout, Stderr string
+	Stdin          string
+	Tty            bool
+	Rows, Cols     int
+	Np, Ppn        int
+	Dist, Bind     string
+	HostfileFormat string
+	JobFiles       map[string][]byte
+	Namespaces     string
+	Hostname       string
+	Root           string
+	Provided       map[string]string // taken out of the bundle; the node has them
+	Limits         Limits
+	Cgroup         string // set by the slave
+	TimeLimit      int64
+	Grace          int64
+	LaunchTimeout  int64
+	Rlimits        []Rlimit
+	Nice           int
+	IoClass        int
+	IoLevel        int
+	Policy         int
+	Priority       int
+	StageOut       []string
+	StageOutMax    int64
+	Lazy           bool
+	Prefetch       []string
+	Args           []string
+	Env            []string
+	EnvTemplates   []string
+	MasterFam      string
+	MasterAddr     string
+	Lfam, Lserver  string
+	JobId          int
+	NodeId         string
+	TotalFileBytes int64
+	StageHeadroom  int64
+	Uid, Gid       int
+}
+
+// res is what the master answers a job with: its ID, or why not, and
+// the nodes it couldn't start the job on.
+type res struct {
+	Msg    []byte
+	JobId  int
+	Failed []string
+}
+
+func (s *JobSpec) stdinMode() string {
+	if s.IO.Tty {
+		return "all"
+	}
+	return s.IO.StdinMode
+}
+
+func (s *JobSpec) stagingOut() bool {
+	return len(s.IO.StageOut) > 0 || s.IO.StdoutFile != "" || s.IO.StderrFile != ""
+}
+
+// check catches what is wrong with the spec before anything is started.
+// The master and the nodes refuse what they can't or won't do.
+func (s *JobSpec) check() (err os.Error) {
+	if len(s.Args) == 0 {
+		return os.NewError("no command")
+	}
+	if len(s.Nodes) == 0 {
+		return os.NewError("no nodes")
+	}
+	err = CheckRanks(s.Nodes, s.Np, s.Ppn, s.Dist)
+	if err != nil {
+		return
+	}
+	err = s.Limits.Check()
+	if err != nil {
+		return
+	}
+	err = checkStdin(s.IO.StdinMode)
+	if err != nil {
+		return
+	}
+	for _, p := range s.IO.StageOut {
+		if _, err := path.Match(p, ""); err != nil {
+			return os.NewError("bad -stageout pattern " + p)
+		}
+	}
+	if s.IO.Tty && JobSize(s.Nodes, s.Np, s.Ppn, s.Dist) != 1 {
+		return os.NewError("-t runs a single process")
+	}
+	if s.Takeout.Lazy && s.Takeout.Bundle != nil {
+		return os.NewError("a bundle made already can't be served lazily")
+	}
+	return
+}
+
+func (s *JobSpec) startArg() StartArg {
+	return StartArg{
+		Nodes:          s.Nodes,
+		LocalBin:       s.Takeout.LocalBin,
+		RawIO:          s.IO.Raw,
+		NodeRedirect:   s.IO.StdoutFile != "" || s.IO.StderrFile != "",
+		Stdout:         s.IO.StdoutFile,
+		Stderr:         s.IO.StderrFile,
+		Stdin:          s.stdinMode(),
+		Tty:            s.IO.Tty,
+		Np:             s.Np,
+		Ppn:            s.Ppn,
+		Dist:           s.Dist,
+		Bind:           s.Bind,
+		HostfileFormat: s.HostfileFormat,
+		Namespaces:     s.Namespaces,
+		Hostname:       s.Hostname,
+		Root:           s.Root,
+		Limits:         s.Limits,
+		TimeLimit:      s.TimeLimit,
+		Grace:          s.Grace,
+		LaunchTimeout:  s.LaunchTimeout,
+		Rlimits:        s.Rlimits,
+		Nice:           s.Nice,
+		IoClass:        s.IoClass,
+		IoLevel:        s.IoLevel,
+		Policy:         s.Policy,
+		Priority:       s.Priority,
+		StageOut:       s.IO.StageOut,
+		StageOutMax:    s.IO.stageOutMax(),
+		Lazy:           s.Takeout.Lazy,
+		Prefetch:       s.Takeout.Prefetch,
+		Args:           s.Args,
+		Env:            s.Env,
+		EnvTemplates:   s.EnvTemplates,
+		StageHeadroom:  s.Headroom,
+	}
+}
+
+// fileVisitor describes the files under the Takeout's Files.
+type fileVisitor struct {
+	hide    func(string) bool
+	entries []bundle.Entry
+}
+
+func (v *fileVisitor) add(p string, f *os.FileInfo) {
+	if v.hide != nil && v.hide(p) {
+		return
+	}
+	e, err := bundle.NewEntry(p[1:], p, f)
+	if err != nil {
+		return
+	}
+	v.entries = append(v.entries, e)
+}
+
+func (v *fileVisitor) VisitDir(p string, f *os.FileInfo) bool {
+	v.add(p, f)
+	return true
+}
+
+func (v *fileVisitor) VisitFile(p string, f *os.FileInfo) {
+	v.add(p, f)
+}
+
+// files is the Takeout's Files, made absolute.
+func (t *Takeout) files() (files []string) {
+	wd, _ := os.Getwd()
+	for _, f := range t.Files {
+		if f == "" {
+			continue
+		}
+		if f[0] != '/' {
+			f = path.Join(wd, f)
+		}
+		files = append(files, path.Clean(f))
+	}
+	return
+}
+
+// allow is what a lazy job's nodes may see.
+func (t *Takeout) allow() (allow []string) {
+	allow = t.files()
+	for _, e := range t.Entries {
+		allow = append(allow, "/"+e.Name)
+	}
+	return
+}
+
+// bundle is the bundle to ship. A lazy job ships an empty one.
+func (t *Takeout) bundle() (data []byte, err os.Error) {
+	if t.Bundle != nil {
+		return t.Bundle, nil
+	}
+	var entries []bundle.Entry
+	if !t.Lazy {
+		entries = append(entries, t.Entries...)
+		v := &fileVisitor{hide: t.Hide}
+		for _, f := range t.files() {
+			path.Walk(f, v, nil)
+		}
+		entries = append(entries, v.entries...)
+	}
+	var b bytes.Buffer
+	err = bundle.Write(&b, "", entries)
+	return b.Bytes(), err
+}
+
+// Launch starts the job and returns a handle on it. Canceling ctx
+// before the job is done kills it, even if the master is starting it
+// just then.
+func (l *Launcher) Launch(ctx context.Context, spec JobSpec) (j *Job, err os.Error) {
+	err = spec.check()
+	if err != nil {
+		return
+	}
+	sa := spec.startArg()
+	data, err := spec.Takeout.bundle()
+	if err != nil {
+		return
+	}
+	sa.TotalFileBytes = int64(len(data))
+
+	j = newJob(l.Master, &spec)
+	// whatever goes wrong from here on, let go of what was set up
+	defer func() {
+		if err != nil {
+			j.release()
+			j = nil
+		}
+	}()
+	nl, err := net.Listen(l.Fam, l.Addr)
+	if err != nil {
+		return
+	}
+	j.listener = &listener{Listener: nl}
+	exp := netchan.NewExporter()
+	go exp.Serve(j.listener)
+	sa.Lfam, sa.Lserver = l.Fam, nl.Addr().String()
+	wchan := make(chan IoData)
+	err = exp.Export("workerData", wchan, netchan.Recv)
+	if err != nil {
+		return
+	}
+	schan := make(chan NodeStatus, len(spec.Nodes))
+	err = exp.Export("statusChan", schan, netchan.Recv)
+	if err != nil {
+		return
+	}
+	in := spec.IO.Stdin
+	if in == nil {
+		in = strings.NewReader("")
+	}
+	err = stdinexport(exp, in, sa.Stdin, JobSize(spec.Nodes, spec.Np, spec.Ppn, spec.Dist))
+	if err != nil {
+		return
+	}
+	if spec.stagingOut() {
+		dir := spec.IO.StageDir
+		if dir == "" {
+			dir = "."
+		}
+		j.stage, err = stageexport(exp, dir, spec.IO.stageOutMax(), spec.IO.StageTar, j.quit)
+		if err != nil {
+			return
+		}
+	}
+	if spec.Takeout.Lazy {
+		err = lazyexport(exp, spec.Nodes, spec.Takeout.allow(), spec.Takeout.Hide)
+		if err != nil {
+			return
+		}
+	}
+	if spec.IO.Tty {
+		sa.Rows, sa.Cols, _ = getWinsize(0)
+		old, err := ttyexport(exp, spec.Nodes[0])
+		if err != nil {
+			return nil, err
+		}
+		j.term = &old
+	}
+	go j.output(wchan)
+
+	conn, err := net.Dial("unix", "", l.Master+".job")
+	if err != nil {
+		return
+	}
+	// closed once the master has answered, or given up on
+	answered := true
+	defer func() {
+		if answered {
+			conn.Close()
+		}
+	}()
+	imp := netchan.NewImporter(conn)
+	sachan := make(chan StartArg)
+	dchan := make(chan []byte)
+	rchan := make(chan res)
+	for _, c := range []struct {
+		name string
+		ch   interface{}
+		dir  netchan.Dir
+	}{
+		{"startArgChan", sachan, netchan.Send},
+		{"filedata", dchan, netchan.Send},
+		{"resChan", rchan, netchan.Recv},
+	} {
+		err = imp.Import(c.name, c.ch, c.dir)
+		if err != nil {
+			return
+		}
+	}
+	select {
+	case sachan <- sa:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case dchan <- data:
+	case <-ctx.Done():
+		// the master has the StartArg and may be on its way
+		answered = false
+		go killLate(l.Master, conn, rchan)
+		return nil, ctx.Err()
+	}
+	var r res
+	select {
+	case r = <-rchan:
+	case <-ctx.Done():
+		answered = false
+		go killLate(l.Master, conn, rchan)
+		return nil, ctx.Err()
+	}
+	if r.JobId == 0 {
+		return nil, os.NewError(string(r.Msg))
+	}
+	j.Id = r.JobId
+	j.fail(r.Failed)
+	go j.wait(ctx, schan)
+	return
+}
+
+// killLate kills the job the master answers with on rchan, after Launch
+// has given up on it, and then hangs up.
+func killLate(master string, conn net.Conn, rchan chan res) {
+	defer conn.Close()
+	select {
+	case r := <-rchan:
+		if closed(rchan) || r.JobId == 0 {
+			return
+		}
+		j := &Job{Id: r.JobId, master: master}
+		if err := j.Signal(syscall.SIGKILL); err != nil {
+			log.Printf("job %d: %v\n", r.JobId, err)
+		}
+	case <-time.After(60e9):
+		log.Print("launch given up on, and the master never answered\n")
+	}
+}
+
+// listener remembers the connections it accepts, so that closing it
+// closes them as well, and the exporter serving them lets go.
+type listener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+	done  bool
+}
+
+func (l *listener) Accept() (c net.Conn, err os.Error) {
+	c, err = l.Listener.Accept()
+	if err != nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.done {
+		c.Close()
+		return nil, os.EINVAL
+	}
+	l.conns = append(l.conns, c)
+	return
+}
+
+func (l *listener) Close() os.Error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.done = true
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+	return l.Listener.Close()
+}
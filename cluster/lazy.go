@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"log"
+	"netchan"
+	"os"
+
+	"gproc-npe.googlecode.com/hg/p9"
+)
+
+// With Takeout.Lazy nothing is shipped up front. The client serves the
+// files it would have shipped over 9P2000.L, a pair of channels per node
+// on the exporter the runners already use for output, and each runner
+// mounts the tree and fetches files as they are opened.
+
+// LazyChans are the names of the channels a node's 9P requests and
+// replies travel on.
+func LazyChans(node string) (t, r string) {
+	return "9p/" + node + "/t", "9p/" + node + "/r"
+}
+
+// A ChanConn is a byte stream over a pair of channels, In for what is
+// read and Out for what is written.
+type ChanConn struct {
+	In  chan []byte
+	Out chan []byte
+	buf []byte
+}
+
+func NewChanConn() *ChanConn {
+	return &ChanConn{In: make(chan []byte), Out: make(chan []byte)}
+}
+
+func (c *ChanConn) Read(b []byte) (n int, err os.Error) {
+	for len(c.buf) == 0 {
+		c.buf = <-c.In
+		if closed(c.In) {
+			return 0, os.EOF
+		}
+	}
+	n = copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return
+}
+
+func (c *ChanConn) Write(b []byte) (int, os.Error) {
+	d := make([]byte, len(b))
+	copy(d, b)
+	c.Out <- d
+	return len(b), nil
+}
+
+// lazyexport serves the files in allow to each node, less those hide
+// says no to.
+func lazyexport(exp *netchan.Exporter, nodes, allow []string, hide func(string) bool) (err os.Error) {
+	fs := &p9.LocalFS{Allow: allow, Hide: hide}
+	for _, n := range nodes {
+		tname, rname := LazyChans(n)
+		c := NewChanConn()
+		err = exp.Export(tname, c.In, netchan.Recv)
+		if err != nil {
+			return
+		}
+		err = exp.Export(rname, c.Out, netchan.Send)
+		if err != nil {
+			return
+		}
+		go func(n string) {
+			s := &p9.Server{FS: fs}
+			if err := s.Serve(c); err != nil && err != os.EOF {
+				log.Printf("9p to %s: %v\n", n, err)
+			}
+		}(n)
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+)
+
+// RankMap returns the ranks on each node, in node list order. np is
+// the number of processes in all and ppn the number per node; either
+// can be 0 to have it worked out from the other, and both to have one
+// process per node. dist is block, to fill each node before going on to
+// the next, or cyclic, to deal ranks out a node at a time. The client,
+// the runners and anything else that needs to know where a rank lives
+// all compute the same map, so it never has to travel.
+func RankMap(nodes []string, np, ppn int, dist string) (ranks [][]int) {
+	n := len(nodes)
+	ranks = make([][]int, n)
+	if n == 0 {
+		return
+	}
+	if np <= 0 && ppn <= 0 {
+		ppn = 1
+	}
+	if np <= 0 {
+		np = n * ppn
+	}
+	if ppn <= 0 {
+		ppn = (np + n - 1) / n
+	}
+	if np > n*ppn {
+		np = n * ppn
+	}
+	r := 0
+	switch dist {
+	case "cyclic":
+		for i := 0; r < np; i = (i + 1) % n {
+			if len(ranks[i]) < ppn {
+				ranks[i] = append(ranks[i], r)
+				r++
+			}
+		}
+	default:
+		for i := range ranks {
+			for len(ranks[i]) < ppn && r < np {
+				ranks[i] = append(ranks[i], r)
+				r++
+			}
+		}
+	}
+	return
+}
+
+// JobSize is the number of processes in a job.
+func JobSize(nodes []string, np, ppn int, dist string) (n int) {
+	for _, r := range RankMap(nodes, np, ppn, dist) {
+		n += len(r)
+	}
+	return
+}
+
+// CheckRanks makes sure np, ppn and dist make sense for the nodes given.
+func CheckRanks(nodes []string, np, ppn int, dist string) os.Error {
+	switch dist {
+	case "", "block", "cyclic":
+	default:
+		return os.NewError("unknown -dist " + dist)
+	}
+	if np < 0 || ppn < 0 {
+		return os.NewError("-np and -ppn can't be negative")
+	}
+	if np > 0 && ppn > 0 && np > len(nodes)*ppn {
+		return os.NewError(fmt.Sprintf("-np %d won't fit on %d nodes at -ppn %d", np, len(nodes), ppn))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"netchan"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+)
+
+// Stage-out brings files the job wrote back to the client. Once its
+// processes are done each runner bundles up the files in the job
+// directory that match any of the job's patterns, along with anything
+// in its stage-out directory, and sends the bundle back a piece at a
+// time on the "stageout" channel the client exports. The client unpacks
+// each node's bundle under <dir>/<jobid>/<node>/, or writes it out as
+// <dir>/<jobid>/<node>.tar. A node sends no more than the job's limit;
+// what doesn't fit is left behind, and the client says so.
+
+// StageChunk is the most a runner puts in one StageData.
+const StageChunk = 64 << 10
+
+// DefaultStageOutMax is the most stage-out taken from a node when the
+// IOSpec doesn't say.
+const DefaultStageOutMax = 256 << 20
+
+func (o *IOSpec) stageOutMax() int64 {
+	if o.StageOutMax <= 0 {
+		return DefaultStageOutMax
+	}
+	return o.StageOutMax
+}
+
+// StageBufferMax is the most stage-out the client holds at once, over
+// all the nodes. A node whose bundle would take it over is dropped.
+const StageBufferMax = 1 << 30
+
+// StageData is a piece of a node's stage-out bundle.
+type StageData struct {
+	JobId int
+	Node  string
+	Data  []byte
+	Last  bool
+	Err   string
+}
+
+// stageCollector is the client side.
+type stageCollector struct {
+	lock  sync.Mutex
+	dir   string
+	max   int64
+	tar   bool
+	bufs  map[string]*bytes.Buffer
+	held  int64 // in bufs, in all
+	over  map[string]bool
+	done  map[string]bool
+	dchan chan string
+}
+
+func stageexport(exp *netchan.Exporter, dir string, max int64, tar bool, quit chan bool) (s *stageCollector, err os.Error) {
+	c := make(chan StageData)
+	err = exp.Export("stageout", c, netchan.Recv)
+	if err != nil {
+		return
+	}
+	s = &stageCollector{
+		dir:   dir,
+		max:   max,
+		tar:   tar,
+		bufs:  make(map[string]*bytes.Buffer),
+		over:  make(map[string]bool),
+		done:  make(map[string]bool),
+		dchan: make(chan string, 1),
+	}
+	go func() {
+		for {
+			select {
+			case d := <-c:
+				s.add(d)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return
+}
+
+func (s *stageCollector) add(d StageData) {
+	if d.Node == "" || d.Node == "." || d.Node == ".." || strings.Index(d.Node, "/") >= 0 {
+		log.Printf("stage-out from bad node name %q, dropped\n", d.Node)
+		return
+	}
+	s.lock.Lock()
+	b, ok := s.bufs[d.Node]
+	if !ok {
+		b = new(bytes.Buffer)
+		s.bufs[d.Node] = b
+	}
+	// the node is meant to keep to the limit; room for the file list too
+	switch n := int64(len(d.Data)); {
+	case s.over[d.Node]:
+	case int64(b.Len())+n > s.max+StageChunk, s.held+n > StageBufferMax:
+		s.over[d.Node] = true
+		s.held -= int64(b.Len())
+		b.Reset()
+	default:
+		b.Write(d.Data)
+		s.held += n
+	}
+	if !d.Last {
+		s.lock.Unlock()
+		return
+	}
+	over := s.over[d.Node]
+	size := int64(b.Len())
+	s.bufs[d.Node] = nil, false
+	s.over[d.Node] = false, false
+	s.lock.Unlock()
+
+	switch {
+	case d.Err != "":
+		log.Printf("stage-out from %s: %s\n", d.Node, d.Err)
+	case over:
+		log.Printf("stage-out from %s: more than %d bytes, or more than the client holds, dropped\n", d.Node, s.max)
+	}
+	// a node whose job never ran sends only why
+	if !over && (size > 0 || d.Err == "") {
+		if err := s.write(d.JobId, d.Node, b); err != nil {
+			log.Printf("stage-out from %s: %v\n", d.Node, err)
+		}
+	}
+	s.lock.Lock()
+	s.held -= size
+	s.done[d.Node] = true
+	s.lock.Unlock()
+	select {
+	case s.dchan <- d.Node:
+	default:
+	}
+}
+
+func (s *stageCollector) write(jobid int, node string, b *bytes.Buffer) (err os.Error) {
+	dir := path.Join(s.dir, fmt.Sprint(jobid))
+	if !s.tar {
+		_, err = bundle.Extract(b, path.Join(dir, node))
+		return
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(path.Join(dir, node+".tar"), os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return bundle.Tar(b, f)
+}
+
+// wait waits for the stage-out from each node, for at most timeout
+// seconds in all.
+func (s *stageCollector) wait(nodes []string, timeout int64) {
+	deadline := time.After(timeout * 1e9)
+	for {
+		s.lock.Lock()
+		var missing []string
+		for _, n := range nodes {
+			if !s.done[n] {
+				missing = append(missing, n)
+			}
+		}
+		s.lock.Unlock()
+		if len(missing) == 0 {
+			return
+		}
+		select {
+		case <-s.dchan:
+		case <-deadline:
+			log.Printf("no stage-out from %s\n", strings.Join(missing, ","))
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package cluster
+
+import (
+	"netchan"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// With IO.Tty the job is one process on a pseudo-terminal, for editors,
+// top and gdb, and this process's terminal is its keyboard and screen.
+// The client puts its own terminal in raw mode, so ^C and friends travel
+// as bytes and the remote line discipline turns them into signals. What
+// does not travel as bytes -- window size changes and the signals sent
+// to the client itself -- goes as a TtyCtl on a per-node channel.
+
+// A TtyCtl is a window size change or a signal for a tty job.
+type TtyCtl struct {
+	Rows, Cols int
+	Sig        int
+}
+
+// TtyChan is the name of the channel a node's TtyCtl messages come on.
+func TtyChan(node string) string {
+	return "tty/" + node
+}
+
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+func ioctl(fd, req int, arg uintptr) os.Error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), arg)
+	if e != 0 {
+		return os.Errno(e)
+	}
+	return nil
+}
+
+func getWinsize(fd int) (rows, cols int, err os.Error) {
+	var ws winsize
+	err = ioctl(fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	return int(ws.Row), int(ws.Col), err
+}
+
+// makeRaw does what cfmakeraw does and returns the old settings.
+func makeRaw(fd int) (old syscall.Termios, err os.Error) {
+	err = ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old)))
+	if err != nil {
+		return
+	}
+	t := old
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	err = ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	return
+}
+
+func restoreTerm(fd int, t syscall.Termios) os.Error {
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+// ttyexport sets up the tty channel for the node and forwards window
+// size changes and signals to it. The caller puts the terminal back
+// with restoreTerm when the session ends.
+func ttyexport(exp *netchan.Exporter, node string) (old syscall.Termios, err os.Error) {
+	c := make(chan TtyCtl)
+	err = exp.Export(TtyChan(node), c, netchan.Send)
+	if err != nil {
+		return
+	}
+	old, err = makeRaw(0)
+	if err != nil {
+		return
+	}
+	go func() {
+		for sig := range signal.Incoming {
+			s, ok := sig.(os.UnixSignal)
+			if !ok {
+				continue
+			}
+			switch int(s) {
+			case syscall.SIGWINCH:
+				rows, cols, err := getWinsize(0)
+				if err == nil {
+					c <- TtyCtl{Rows: rows, Cols: cols}
+				}
+			case syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM,
+				syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGCONT:
+				c <- TtyCtl{Sig: int(s)}
+			}
+		}
+	}()
+	return
+}
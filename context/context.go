@@ -0,0 +1,85 @@
+// Package context carries cancellation and deadlines across calls that
+// block, so that whoever started something can give up on it. It is
+// the small part of the idea that gproc needs: a Context is done when
+// it is canceled, when its deadline passes, or when its parent is done,
+// and then Err says which.
+package context
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// A Context is done once the channel Done returns is closed.
+type Context interface {
+	Done() <-chan bool
+	Err() os.Error
+}
+
+// A CancelFunc cancels its Context. It can be called more than once.
+type CancelFunc func()
+
+var (
+	Canceled         = os.NewError("context canceled")
+	DeadlineExceeded = os.NewError("context deadline exceeded")
+)
+
+type background struct{}
+
+func (background) Done() <-chan bool { return nil }
+func (background) Err() os.Error     { return nil }
+
+// Background is never done.
+func Background() Context {
+	return background{}
+}
+
+type cancelCtx struct {
+	lock sync.Mutex
+	done chan bool
+	err  os.Error
+}
+
+func (c *cancelCtx) Done() <-chan bool { return c.done }
+
+func (c *cancelCtx) Err() os.Error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *cancelCtx) cancel(err os.Error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
+
+// WithCancel returns a Context that is done when cancel is called or
+// when parent is done, whichever comes first.
+func WithCancel(parent Context) (Context, CancelFunc) {
+	return withDeadline(parent, nil)
+}
+
+// WithTimeout returns a Context that is also done after ns nanoseconds.
+func WithTimeout(parent Context, ns int64) (Context, CancelFunc) {
+	return withDeadline(parent, time.After(ns))
+}
+
+func withDeadline(parent Context, deadline <-chan int64) (Context, CancelFunc) {
+	c := &cancelCtx{done: make(chan bool)}
+	go func() {
+		select {
+		case <-parent.Done():
+			c.cancel(parent.Err())
+		case <-deadline:
+			c.cancel(DeadlineExceeded)
+		case <-c.done:
+		}
+	}()
+	return c, func() { c.cancel(Canceled) }
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* A slave started with -cgroup puts each job in a cgroup v2 child of
+ * that directory, which must be delegated to the slave (the controllers
+ * wanted enabled in its cgroup.subtree_control, and owned by the slave's
+ * user if it is rootless). The slave makes the cgroup and moves the
+ * runner into it before the runner has started anything, so every
+ * process of the job lands there. The cgroup carries the job's limits,
+ * lets kill reach processes that have left their process groups,
+ * and at the end says how much memory and CPU the job used: the runner
+ * reads it just before it reports its status, which carries it to the
+ * client, and the slave again once the runner is gone, for ps. The limits
+ * themselves are cluster.Limits, since a client sets them too. A cgroup
+ * is named for the job and its runner's pid, as job ids start over with
+ * each master and another slave may share the parent. A job that didn't
+ * get one runs without limits, and kill goes by process groups.
+ */
+
+const cpuPeriod = 100000
+
+/* parseSize takes a number of bytes with an optional K, M, G or T. */
+func parseSize(s string) (n int64, err os.Error) {
+	if s == "" {
+		return
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err = strconv.Atoi64(s)
+	if err != nil {
+		return 0, os.NewError("bad size " + s)
+	}
+	return n * mult, nil
+}
+
+func cgroupPath(jobid, pid int) string {
+	if *cgroupParent == "" {
+		return ""
+	}
+	return path.Join(*cgroupParent, fmt.Sprintf("job%d.%d", jobid, pid))
+}
+
+func cgwrite(dir, file, value string) (err os.Error) {
+	f, err := os.Open(path.Join(dir, file), os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(value))
+	return
+}
+
+/* newCgroup makes the job's cgroup, sets its limits and moves pid into it. */
+func newCgroup(arg *StartArg, pid int) (dir string, err os.Error) {
+	dir = cgroupPath(arg.JobId, pid)
+	if dir == "" {
+		return
+	}
+	/* already on if the slice was delegated properly; we try anyway */
+	cgwrite(*cgroupParent, "cgroup.subtree_control", "+memory +cpu +pids +io")
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return
+	}
+	l := arg.Limits
+	var limits [][2]string
+	if l.MemMax > 0 {
+		limits = append(limits, [2]string{"memory.max", strconv.Itoa64(l.MemMax)})
+	}
+	if l.Cpus > 0 {
+		limits = append(limits, [2]string{"cpu.max", fmt.Sprintf("%d %d", int64(l.Cpus*cpuPeriod), cpuPeriod)})
+	}
+	if l.PidsMax > 0 {
+		limits = append(limits, [2]string{"pids.max", strconv.Itoa(l.PidsMax)})
+	}
+	if l.IoWeight > 0 {
+		limits = append(limits, [2]string{"io.weight", "default " + strconv.Itoa(l.IoWeight)})
+	}
+	for _, kv := range limits {
+		err = cgwrite(dir, kv[0], kv[1])
+		if err != nil {
+			removeCgroup(dir)
+			return "", err
+		}
+	}
+	err = cgwrite(dir, "cgroup.procs", strconv.Itoa(pid))
+	if err != nil {
+		removeCgroup(dir)
+		return "", err
+	}
+	return
+}
+
+func cgroupProcs(dir string) (pids []int) {
+	b, err := ioutil.ReadFile(path.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, s := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(s); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
+
+/* cgroupSignal sends sig to every process in the cgroup but spare, the
+ * runner, which has to live to report the job's status. With no one to
+ * spare SIGKILL goes through cgroup.kill where the kernel has it;
+ * otherwise it is sent until nothing but spare is left, so that a
+ * process that forks can't outrun it.
+ */
+func cgroupSignal(dir string, sig, spare int) (err os.Error) {
+	if sig == syscall.SIGKILL && spare == 0 && cgwrite(dir, "cgroup.kill", "1") == nil {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		left := false
+		for _, pid := range cgroupProcs(dir) {
+			if pid == spare {
+				continue
+			}
+			left = true
+			if e := syscall.Kill(pid, sig); e != 0 && e != syscall.ESRCH {
+				err = os.Errno(e)
+			}
+		}
+		if !left || sig != syscall.SIGKILL {
+			break
+		}
+	}
+	return
+}
+
+/* cgroupUsage reads the job's peak memory in bytes and CPU time in microseconds. */
+func cgroupUsage(dir string) (mem, cpu int64) {
+	if b, err := ioutil.ReadFile(path.Join(dir, "memory.peak")); err == nil {
+		mem, _ = strconv.Atoi64(strings.TrimSpace(string(b)))
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, "cpu.stat"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n", -1) {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == "usage_usec" {
+			cpu, _ = strconv.Atoi64(f[1])
+		}
+	}
+	return
+}
+
+/* nodeStatus is the runner's report of how the job ended on this node,
+ * with what the job used there if the slave put it in a cgroup.
+ */
+func nodeStatus(arg *StartArg, status int) (s cluster.NodeStatus) {
+	s = cluster.NodeStatus{Node: arg.NodeId, Status: status}
+	if arg.Cgroup != "" {
+		s.MemPeak, s.CpuUsec = cgroupUsage(arg.Cgroup)
+	}
+	return
+}
+
+/* removeCgroup gets rid of the cgroup, taking anything still in it along. */
+func removeCgroup(dir string) {
+	if len(cgroupProcs(dir)) > 0 {
+		cgroupSignal(dir, syscall.SIGKILL, 0)
+	}
+	syscall.Rmdir(dir)
+}
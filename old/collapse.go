@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* With a few hundred nodes most of what comes back is the same thing
+ * over and over. In collapse mode we hold on to every node's output
+ * until the job is done, then print each distinct output once under a
+ * header naming the hosts that produced it, the way dshbak -c does.
+ * The streaming variant can't wait for the end, so it prints each
+ * distinct line the first time it shows up and the counts at the end.
+ */
+
+type outputter interface {
+	write(d cluster.IoData)
+	flush()
+}
+
+/* plain is the default: print it as it comes */
+type plain struct {
+	label bool
+}
+
+func (p *plain) write(d cluster.IoData) {
+	ioprint(d, p.label)
+}
+
+func (p *plain) flush() {
+}
+
+/* hostOf names the host d came from, for the headers. Each process
+ * still has its own buffer; only the names are by host.
+ */
+func hostOf(d cluster.IoData) string {
+	if d.Host == "" {
+		return d.Src
+	}
+	return d.Host
+}
+
+type collapser struct {
+	lock  sync.Mutex
+	bufs  [3]map[string]*bytes.Buffer
+	hosts map[string]string
+}
+
+func newCollapser() *collapser {
+	c := &collapser{hosts: make(map[string]string)}
+	for i := range c.bufs {
+		c.bufs[i] = make(map[string]*bytes.Buffer)
+	}
+	return c
+}
+
+func (c *collapser) write(d cluster.IoData) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b, ok := c.bufs[d.Fd][d.Src]
+	if !ok {
+		b = new(bytes.Buffer)
+		c.bufs[d.Fd][d.Src] = b
+		c.hosts[d.Src] = hostOf(d)
+	}
+	b.Write(d.Data)
+}
+
+func (c *collapser) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for fd, out := range []*os.File{nil, os.Stdout, os.Stderr} {
+		if out == nil {
+			continue
+		}
+		groups := make(map[string][]string)
+		for n, b := range c.bufs[fd] {
+			groups[b.String()] = append(groups[b.String()], c.hosts[n])
+		}
+		for _, g := range sortGroups(groups) {
+			fmt.Fprintf(out, "----------------\n%s\n----------------\n%s",
+				hostlist(groups[g]), g)
+		}
+		c.bufs[fd] = make(map[string]*bytes.Buffer)
+	}
+}
+
+/* lineCount is the streaming variant. */
+type lineCount struct {
+	lock  sync.Mutex
+	seen  [3]map[string][]string
+	order [3][]string
+}
+
+func newLineCount() *lineCount {
+	l := &lineCount{}
+	for i := range l.seen {
+		l.seen[i] = make(map[string][]string)
+	}
+	return l
+}
+
+func (l *lineCount) write(d cluster.IoData) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	out := os.Stdout
+	if d.Fd == 2 {
+		out = os.Stderr
+	}
+	for _, s := range strings.SplitAfter(string(d.Data), "\n", -1) {
+		if s == "" {
+			continue
+		}
+		nodes, ok := l.seen[d.Fd][s]
+		if !ok {
+			l.order[d.Fd] = append(l.order[d.Fd], s)
+			fmt.Fprint(out, s)
+		}
+		l.seen[d.Fd][s] = append(nodes, hostOf(d))
+	}
+}
+
+func (l *lineCount) flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for fd, out := range []*os.File{nil, os.Stdout, os.Stderr} {
+		if out == nil || len(l.order[fd]) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "----------------\n")
+		for _, s := range l.order[fd] {
+			nodes := l.seen[fd][s]
+			fmt.Fprintf(out, "%6d %s: %s", len(nodes), hostlist(nodes), s)
+		}
+	}
+}
+
+func newOutputter(size int) (out outputter) {
+	switch {
+	case *collapse:
+		out = newCollapser()
+	case *collapseStream:
+		out = newLineCount()
+	default:
+		out = &plain{label: labelio(size)}
+	}
+	if !*nodeRedirect && (*stdoutTemplate != "" || *stderrTemplate != "") {
+		out = newRedirector(*stdoutTemplate, *stderrTemplate, out)
+	}
+	return
+}
+
+/* sortGroups orders the groups of identical output by their first host.
+ * Ranks on one host can land in different groups, so groups that share a
+ * first host go in the order of their output.
+ */
+func sortGroups(groups map[string][]string) []string {
+	g := &byFirst{groups: groups}
+	for k, nodes := range groups {
+		sort.Sort(hostNames(nodes))
+		g.keys = append(g.keys, k)
+	}
+	sort.Sort(g)
+	return g.keys
+}
+
+type byFirst struct {
+	keys   []string
+	groups map[string][]string
+}
+
+func (g *byFirst) Len() int      { return len(g.keys) }
+func (g *byFirst) Swap(i, j int) { g.keys[i], g.keys[j] = g.keys[j], g.keys[i] }
+func (g *byFirst) Less(i, j int) bool {
+	hi := g.groups[g.keys[i]][0]
+	hj := g.groups[g.keys[j]][0]
+	if hi != hj {
+		return hostNames{hi, hj}.Less(0, 1)
+	}
+	return g.keys[i] < g.keys[j]
+}
+
+/* splitHost splits a node name into a prefix and its trailing digits. */
+func splitHost(h string) (prefix, digits string) {
+	i := len(h)
+	for i > 0 && '0' <= h[i-1] && h[i-1] <= '9' {
+		i--
+	}
+	return h[:i], h[i:]
+}
+
+type hostNames []string
+
+func (h hostNames) Len() int      { return len(h) }
+func (h hostNames) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hostNames) Less(i, j int) bool {
+	pi, di := splitHost(h[i])
+	pj, dj := splitHost(h[j])
+	if pi != pj || di == "" || dj == "" {
+		return h[i] < h[j]
+	}
+	ni, _ := strconv.Atoi64(di)
+	nj, _ := strconv.Atoi64(dj)
+	if ni != nj {
+		return ni < nj
+	}
+	return len(di) < len(dj)
+}
+
+/* hostlist folds a set of node names into the compact form pdsh uses,
+ * e.g. cn001 ... cn040 and cn042 become cn[001-040,042]. Numbers only
+ * join a range if they are padded to the same width. A name that comes
+ * up more than once, as a host running several ranks does, is listed once.
+ */
+func hostlist(nodes []string) string {
+	h := make([]string, len(nodes))
+	copy(h, nodes)
+	sort.Sort(hostNames(h))
+	if len(h) > 0 {
+		u := h[:1]
+		for _, n := range h[1:] {
+			if n != u[len(u)-1] {
+				u = append(u, n)
+			}
+		}
+		h = u
+	}
+	var out []string
+	for i := 0; i < len(h); {
+		prefix, digits := splitHost(h[i])
+		if digits == "" {
+			out = append(out, h[i])
+			i++
+			continue
+		}
+		var ranges []string
+		n := 0
+		for i < len(h) {
+			p, d := splitHost(h[i])
+			if p != prefix || d == "" {
+				break
+			}
+			start, _ := strconv.Atoi64(d)
+			end := start
+			width := len(d)
+			i++
+			for i < len(h) {
+				p, d := splitHost(h[i])
+				v, _ := strconv.Atoi64(d)
+				if p != prefix || len(d) != width || v != end+1 {
+					break
+				}
+				end = v
+				i++
+			}
+			n += int(end-start) + 1
+			if start == end {
+				ranges = append(ranges, fmt.Sprintf("%0*d", width, start))
+			} else {
+				ranges = append(ranges, fmt.Sprintf("%0*d-%0*d", width, start, width, end))
+			}
+		}
+		if n == 1 {
+			out = append(out, prefix+ranges[0])
+		} else {
+			out = append(out, prefix+"["+strings.Join(ranges, ",")+"]")
+		}
+	}
+	return strings.Join(out, ",")
+}
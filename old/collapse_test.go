@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostlist(t *testing.T) {
+	for _, tt := range []struct {
+		nodes string
+		want  string
+	}{
+		{"", ""},
+		{"cn001", "cn001"},
+		{"cn003 cn001 cn002", "cn[001-003]"},
+		{"cn001 cn002 cn004 cn005 cn007", "cn[001-002,004-005,007]"},
+		{"cn9 cn10 cn11", "cn[9-11]"},
+		{"cn09 cn10", "cn[09-10]"},
+		{"cn9 cn010", "cn[9,010]"},
+		{"b1 a2 a1 b2", "a[1-2],b[1-2]"},
+		{"r1n3 r1n2 r2n1", "r1n[2-3],r2n1"},
+		{"login cn1", "cn1,login"},
+		{"cn2 cn1 cn2 cn1", "cn[1-2]"},
+	} {
+		var nodes []string
+		if tt.nodes != "" {
+			nodes = strings.Split(tt.nodes, " ", -1)
+		}
+		if got := hostlist(nodes); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.nodes, got, tt.want)
+		}
+	}
+}
+
+func TestSortGroups(t *testing.T) {
+	groups := map[string][]string{
+		"b\n": []string{"cn2", "cn10"},
+		"a\n": []string{"cn1"},
+		"c\n": []string{"cn2"},
+	}
+	got := strings.Join(sortGroups(groups), "")
+	if want := "a\nb\nc\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
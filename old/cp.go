@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gob"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+)
+
+/* gproc cp is bpcp: it copies files to or from a set of nodes without
+ * running anything there.
+ *	gproc cp [-r] <server> SRC... NODES:DEST
+ *	gproc cp [-r] <server> NODES:SRC DEST
+ * The files go to the master as a bundle over the control socket, and
+ * the master hands the bundle to the slaves, all at once, on the copy
+ * channel each slave exports next to its kill channel. Going the other
+ * way each node sends back a bundle of its own; with more than one node
+ * each node's copy lands in DEST/<node>. The slave does each copy in a
+ * child, gproc C, that has the uid and gid of whoever ran cp, as the
+ * master got them from the kernel, and no supplementary groups; it keeps
+ * the owners in the bundle only if that was root. Modes and times are
+ * always kept. A node gets -cptime for its copy before it is given up on.
+ */
+
+type CpArg struct {
+	Src       []string /* on the node, to fetch */
+	Dest      string   /* on the node, to put */
+	Data      []byte   /* the bundle to put */
+	Recursive bool
+	Uid, Gid  int
+	Owners    bool
+	Timeout   int64 /* seconds for the copy on each node; 0 is no limit */
+}
+
+type CpRes struct {
+	Node string
+	Err  string
+	Data []byte
+}
+
+/* cpVisitor collects the entries for one source of a copy. */
+type cpVisitor struct {
+	top     string
+	name    string
+	entries []bundle.Entry
+	err     os.Error
+}
+
+func (v *cpVisitor) add(p string, f *os.FileInfo) {
+	e, err := bundle.NewEntry(v.name+p[len(v.top):], p, f)
+	if err != nil {
+		v.err = err
+		return
+	}
+	v.entries = append(v.entries, e)
+}
+
+func (v *cpVisitor) VisitDir(p string, f *os.FileInfo) bool {
+	v.add(p, f)
+	return true
+}
+
+func (v *cpVisitor) VisitFile(p string, f *os.FileInfo) {
+	if f.IsRegular() || f.IsSymlink() {
+		v.add(p, f)
+	}
+}
+
+/* cpEntries lists what a copy of srcs takes, each under its own last name. */
+func cpEntries(srcs []string, recursive bool) (entries []bundle.Entry, err os.Error) {
+	for _, s := range srcs {
+		s = path.Clean(s)
+		fi, err := os.Lstat(s)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDirectory() && !recursive {
+			return nil, os.NewError(s + " is a directory (not copied)")
+		}
+		_, name := path.Split(s)
+		v := &cpVisitor{top: s, name: name}
+		if fi.IsDirectory() {
+			path.Walk(s, v, nil)
+		} else {
+			v.add(s, fi)
+		}
+		if v.err != nil {
+			return nil, v.err
+		}
+		entries = append(entries, v.entries...)
+	}
+	return
+}
+
+func cpBundle(srcs []string, recursive bool) (b []byte, err os.Error) {
+	entries, err := cpEntries(srcs, recursive)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	err = bundle.Write(&buf, "", entries)
+	return buf.Bytes(), err
+}
+
+/* cpExtract puts a bundle at dest the way cp would: into dest if it is
+ * a directory, or as dest if the bundle holds one file or tree.
+ */
+func cpExtract(r io.Reader, dest string, owners bool) os.Error {
+	base, rename := dest, ""
+	if fi, err := os.Stat(dest); err != nil || !fi.IsDirectory() {
+		base, rename = path.Split(path.Clean(dest))
+	}
+	top := ""
+	x := &bundle.Extractor{Base: base, Owners: owners, Privileged: owners}
+	err := bundle.Scan(r, func(e *bundle.Entry, data io.Reader) (err os.Error) {
+		if rename != "" {
+			t, rest := e.Name, ""
+			if i := strings.Index(t, "/"); i >= 0 {
+				t, rest = t[:i], t[i:]
+			}
+			if top == "" {
+				top = t
+			}
+			if t != top {
+				return os.NewError(dest + ": not a directory")
+			}
+			e.Name = rename + rest
+			if e.HardLink != "" {
+				e.HardLink = rename + e.HardLink[len(top):]
+			}
+		}
+		return x.Entry(e, data)
+	})
+	if err != nil {
+		return err
+	}
+	return x.Finish()
+}
+
+/* copyfiles is the client side of gproc cp. */
+func copyfiles(a []string) (status int) {
+	recursive := false
+	if len(a) > 0 && a[0] == "-r" {
+		recursive = true
+		a = a[1:]
+	}
+	if len(a) < 3 {
+		log.Exitf("Usage: %s cp [-r] <server address> SRC... NODES:DEST | NODES:SRC DEST\n", os.Args[0])
+	}
+	server := a[0]
+	a = a[1:]
+	dest := a[len(a)-1]
+	srcs := a[:len(a)-1]
+	timeout, err := parseTime(*cpTime)
+	if err != nil {
+		log.Exit(err)
+	}
+	ctl := CtlArg{Cmd: "cp", Cp: CpArg{Recursive: recursive, Timeout: timeout}}
+	pull := false
+	switch {
+	case nodeSpec(dest) != "":
+		ctl.Nodes = NodeList(nodeSpec(dest))
+		ctl.Cp.Dest = dest[len(nodeSpec(dest))+1:]
+		b, err := cpBundle(srcs, recursive)
+		if err != nil {
+			log.Exit(err)
+		}
+		ctl.Cp.Data = b
+	case len(srcs) == 1 && nodeSpec(srcs[0]) != "":
+		ctl.Nodes = NodeList(nodeSpec(srcs[0]))
+		ctl.Cp.Src = []string{srcs[0][len(nodeSpec(srcs[0]))+1:]}
+		pull = true
+	default:
+		log.Exit("cp: one side must be NODES:PATH")
+	}
+	res, err := ctlcall(server, ctl)
+	if err != nil {
+		log.Exit(err)
+	}
+	for _, r := range res.Cp {
+		if r.Err == "" && pull {
+			d := dest
+			if len(ctl.Nodes) > 1 {
+				d = path.Join(dest, r.Node)
+				os.MkdirAll(d, 0755)
+			}
+			if err := cpExtract(bytes.NewBuffer(r.Data), d, false); err != nil {
+				r.Err = err.String()
+			}
+		}
+		if r.Err != "" {
+			fmt.Printf("%s: %s\n", r.Node, r.Err)
+			status = 1
+		} else if DebugLevel > 0 {
+			fmt.Printf("%s: ok\n", r.Node)
+		}
+	}
+	return
+}
+
+/* nodeSpec is the NODES part of NODES:PATH, if there is one. */
+func nodeSpec(s string) string {
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.Index(s[:i], "/") >= 0 {
+		return ""
+	}
+	return s[:i]
+}
+
+/* cpSlack is how much longer than a copy's timeout the master waits on
+ * a node, whose slave should have given up on the copy by then.
+ */
+const cpSlack = 30
+
+/* cpnodes is the master side: the same copy on every node, at once. */
+func cpnodes(uid, gid int, nodes []string, a CpArg) []CpRes {
+	a.Uid, a.Gid = uid, gid
+	a.Owners = uid == 0
+	res := make([]CpRes, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		s, ok := Slaves[n]
+		if !ok {
+			res[i] = CpRes{Node: n, Err: "no such node"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, n string, s SlaveInfo) {
+			defer wg.Done()
+			var deadline <-chan int64
+			if a.Timeout > 0 {
+				deadline = time.After((a.Timeout + cpSlack) * 1e9)
+			}
+			s.cplock.Lock()
+			s.cpch <- a
+			select {
+			case res[i] = <-s.cprch:
+				s.cplock.Unlock()
+			case <-deadline:
+				res[i] = CpRes{Err: "cp timed out"}
+				/* the answer may still come; it isn't the next copy's */
+				go func() {
+					<-s.cprch
+					s.cplock.Unlock()
+				}()
+			}
+			res[i].Node = n
+		}(i, n, s)
+	}
+	wg.Wait()
+	return res
+}
+
+/* slavecp does the copies the master sends this node. */
+func slavecp(c chan CpArg, rc chan CpRes) {
+	for {
+		a := <-c
+		r, err := cpfork(&a)
+		if err != nil {
+			r.Err = err.String()
+		}
+		r.Node = NodeId
+		rc <- r
+	}
+}
+
+/* cpfork does a copy in a child, gproc C, that has the groups, gid and
+ * uid of whoever asked for it, so that none of root's come along. A
+ * rootless slave can only copy as itself. The child is killed if it
+ * takes longer than the copy's timeout.
+ */
+func cpfork(a *CpArg) (r CpRes, err os.Error) {
+	sys := &syscall.SysProcAttr{}
+	if *rootless {
+		if a.Uid != os.Getuid() {
+			return r, os.NewError(fmt.Sprintf("rootless slave runs as uid %d and won't copy for uid %d", os.Getuid(), a.Uid))
+		}
+	} else {
+		sys.Credential = &syscall.Credential{Uid: uint32(a.Uid), Gid: uint32(a.Gid), Groups: []uint32{}}
+	}
+	inr, inw, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		inr.Close()
+		inw.Close()
+		return
+	}
+	defer outr.Close()
+	p, err := os.StartProcess("/proc/self/exe", []string{"gproc", "C"}, &os.ProcAttr{
+		Files: []*os.File{inr, outw, os.Stderr},
+		Sys:   sys,
+	})
+	inr.Close()
+	outw.Close()
+	if err != nil {
+		inw.Close()
+		return
+	}
+	stop := make(chan bool, 1)
+	killed := make(chan bool, 1)
+	if a.Timeout > 0 {
+		go func() {
+			select {
+			case <-stop:
+			case <-time.After(a.Timeout * 1e9):
+				p.Kill()
+				killed <- true
+			}
+		}()
+	}
+	go func() {
+		gob.NewEncoder(inw).Encode(a)
+		inw.Close()
+	}()
+	err = gob.NewDecoder(outr).Decode(&r)
+	stop <- true
+	p.Wait(0)
+	if err != nil {
+		select {
+		case <-killed:
+			err = os.NewError("cp timed out")
+		default:
+			err = os.NewError("cp: " + err.String())
+		}
+	}
+	return
+}
+
+/* cphelper is the child of cpfork: it does the one copy it reads from
+ * stdin, with the ids it was started with, and writes back the result.
+ */
+func cphelper() int {
+	var a CpArg
+	var r CpRes
+	err := gob.NewDecoder(os.Stdin).Decode(&a)
+	if err != nil {
+		log.Printf("cp: %v\n", err)
+		return 1
+	}
+	if len(a.Src) > 0 {
+		r.Data, err = cpBundle(a.Src, a.Recursive)
+	} else {
+		err = cpExtract(bytes.NewBuffer(a.Data), a.Dest, a.Owners)
+	}
+	if err != nil {
+		r.Err = err.String()
+	}
+	err = gob.NewEncoder(os.Stdout).Encode(r)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* The environment of a remote process is built in three layers. The
+ * client's own environment, as much of it as -export asks for, goes in
+ * StartArg.Env along with the library path. The -env settings go in
+ * StartArg.EnvTemplates and are expanded on the node with the same
+ * %j, %n, %r and %h as the -o and -e file names, so each rank can get
+ * its own value. Last, the runner sets the GPROC_ variables, which
+ * parallel programs use to find out where they are:
+ *	GPROC_JOBID		the job ID
+ *	GPROC_RANK		this process's rank in the job
+ *	GPROC_SIZE		the number of processes in the job
+ *	GPROC_NODEID		the node's ID
+ *	GPROC_LOCAL_RANK	the process's rank among those on this node
+ *	GPROC_LOCAL_SIZE	the number of processes on this node
+ *	GPROC_MASTER_ADDR	the master, as the slave reaches it
+ *	GPROC_PMI_SOCK		the key-value service for the job
+ * along with PMI_RANK and PMI_SIZE for PMI-1 programs.
+ * Later settings replace earlier ones with the same name.
+ */
+
+/* envList is a flag that can be given more than once */
+type envList []string
+
+func (e *envList) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envList) Set(s string) bool {
+	if strings.Index(s, "=") <= 0 {
+		return false
+	}
+	*e = append(*e, s)
+	return true
+}
+
+var envSettings envList
+
+func envName(kv string) string {
+	if i := strings.Index(kv, "="); i >= 0 {
+		return kv[:i]
+	}
+	return kv
+}
+
+/* setEnv sets kv in env, replacing any setting of the same name. */
+func setEnv(env []string, kv string) []string {
+	name := envName(kv)
+	for i, s := range env {
+		if envName(s) == name {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+/* exportEnv picks the client environment to send along: ALL, NONE or a
+ * comma-separated list of names.
+ */
+func exportEnv(export string) (env []string) {
+	switch strings.ToUpper(export) {
+	case "NONE", "":
+		return
+	case "ALL":
+		return os.Environ()
+	}
+	for _, name := range strings.Split(export, ",", -1) {
+		if v := os.Getenv(name); v != "" {
+			env = append(env, name+"="+v)
+		}
+	}
+	return
+}
+
+/* procEnv is the environment for one process on a node. */
+func procEnv(arg *StartArg, rank, size, localRank, localSize int) []string {
+	host, _ := os.Hostname()
+	env := make([]string, len(arg.Env))
+	copy(env, arg.Env)
+	for _, t := range arg.EnvTemplates {
+		env = setEnv(env, expandTemplate(t, arg.JobId, arg.NodeId, rank, host))
+	}
+	for _, kv := range []string{
+		"GPROC_JOBID=" + strconv.Itoa(arg.JobId),
+		"GPROC_RANK=" + strconv.Itoa(rank),
+		"GPROC_SIZE=" + strconv.Itoa(size),
+		"GPROC_NODEID=" + arg.NodeId,
+		"GPROC_LOCAL_RANK=" + strconv.Itoa(localRank),
+		"GPROC_LOCAL_SIZE=" + strconv.Itoa(localSize),
+		"GPROC_MASTER_ADDR=" + arg.MasterAddr,
+		"PMI_RANK=" + strconv.Itoa(rank),
+		"PMI_SIZE=" + strconv.Itoa(size),
+	} {
+		env = setEnv(env, kv)
+	}
+	if arg.pmisock != "" {
+		env = setEnv(env, "GPROC_PMI_SOCK="+arg.pmisock)
+	}
+	return env
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"log"
 	"os"
 	"net"
@@ -9,12 +10,17 @@ import (
 	"syscall"
 	"strconv"
 	"strings"
+	"sync"
+	"runtime"
 	"gob"
 	"flag"
 	"json"
 	"io/ioutil"
 	"netchan"
-	"path"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+	"gproc-npe.googlecode.com/hg/cluster"
+	"gproc-npe.googlecode.com/hg/context"
 )
 
 type Arg struct {
@@ -22,31 +28,32 @@ type Arg struct {
 }
 
 type Res struct {
-	Msg []byte
+	Msg    []byte
+	Node   string
+	Pid    int
+	JobId  int
+	Stale  bool     // a provided file has changed; send everything
+	Failed []string // from the master: nodes the job couldn't be started on
 }
 
 type SlaveArg struct {
-	a   string
-	id  string
-	Msg []byte
+	Addr     string // where the slave's control channels are
+	HostAddr string // the slave's IP address, as the master reaches it
+	Id       string
+	Host     string
+	Class    string
+	Provided map[string]string
+	Msg      []byte
 }
 
 type SlaveRes struct {
-	id string
+	Id string
 }
 
 type SetDebugLevel struct {
 	level int
 }
 
-type Acmd struct {
-	name         string
-	fullpathname string
-	local        int
-	fi           os.FileInfo
-	file         *File
-}
-
 type noderange struct {
 	Base int
 	Ip   string
@@ -54,27 +61,36 @@ type noderange struct {
 
 type gpconfig struct {
 	Noderanges []noderange
+	Caps       SiteCaps
+	Takeout    TakeoutRules
 }
 
+/* StartArg is what a runner is started with: the cluster.StartArg the
+ * client made and the master and slave filled in, and what the runner
+ * works out for itself on the node.
+ */
 type StartArg struct {
-	Nodes          []string // nodes that have contacted you
-	Peers          []string // addr/port strings to exec build the ad-hoc tree
-	ThisNode       bool
-	LocalBin       bool
-	Args           []string
-	Env            []string
-	Lfam, Lserver  string
-	totalfilebytes int64
-	uid, gid       int
-	cmds           []Acmd
+	cluster.StartArg
+	newroot string
+	shipped []string
+	pmisock string
 }
 
 type SlaveInfo struct {
 	id     string
 	Addr   string
+	Host   string
+	Class  string
 	client net.Conn
 	ch     chan int
 	dch    chan []byte
+	rch    chan Res
+	kch    chan KillArg
+	cpch   chan CpArg
+	cprch  chan CpRes
+	cplock *sync.Mutex
+	kvsd   chan KvsData
+	ldlock *sync.Mutex /* held from a launch until the slave answers it */
 }
 
 type Worker struct {
@@ -89,6 +105,9 @@ var localbin = false
 var DebugLevel int
 var Logfile = "/tmp/log"
 var Slaves map[string]SlaveInfo
+var NodeId string
+var MasterFam, MasterAddr string
+var siteCaps SiteCaps
 var DoPrivateMount = true
 var Workers []Worker
 
@@ -100,33 +119,55 @@ var (
 	takeout = flag.String("f", "", "comma-seperated list of files/directories to take along")
 	root    = flag.String("r", "", "root for finding binaries")
 	libs    = flag.String("L", "/lib:/usr/lib", "library path")
-)
-
-
-/* we do the files here. We push the files and then the directories. We just push them on,
- * duplicates and all, and do the dedup later when we pop them.
- */
+	longps  = flag.Bool("l", false, "ps: list the processes of each job")
+	killsig = flag.String("s", "TERM", "kill: signal to send")
+	label   = flag.Bool("label", false, "prefix output lines with [node]")
+	nolabel = flag.Bool("nolabel", false, "never prefix output lines")
+	rawio   = flag.Bool("raw", false, "relay output as it comes, no line buffering or labels")
 
-type ProcVisitor struct {
-	flist      []Acmd
-	totalbytes int
-}
+	collapse       = flag.Bool("collapse", false, "print identical output from many nodes once")
+	collapseStream = flag.Bool("collapsestream", false, "print distinct output lines as they arrive, with counts at the end")
+	stdoutTemplate = flag.String("o", "", "write each node's stdout to this file (%j job, %n node, %r rank, %h host)")
+	stderrTemplate = flag.String("e", "", "write each node's stderr to this file (%j job, %n node, %r rank, %h host)")
+	nodeRedirect   = flag.Bool("noderedirect", false, "have the nodes write the -o and -e files into their stage-out directory")
+	stdinMode      = flag.String("stdin", "none", "where stdin goes: none, rank0, all or scatter")
+	tty            = flag.Bool("t", false, "run the command on a pseudo-terminal on a single node")
+	exportMode     = flag.String("export", "NONE", "client environment to pass on: ALL, NONE or a comma-separated list")
+	np             = flag.Int("np", 0, "number of processes in all; default is -ppn on every node")
+	ppn            = flag.Int("ppn", 0, "processes per node; default is 1, or enough to fit -np")
+	dist           = flag.String("dist", "block", "how ranks are laid out on the nodes: block or cyclic")
+	bind           = flag.String("bind", "none", "bind each process to a core, a socket, or none")
+	hostfile       = flag.String("hostfile", "plain", "format of the job's hostfile: plain, mpich or openmpi")
+	namespaces     = flag.String("ns", "ipc,uts,pid", "namespaces for the job besides mount: any of ipc, uts, pid, net")
+	nsHostname     = flag.String("nshostname", "", "host name in the job's uts namespace (%j job, %n node, %h host)")
+	rootless       = flag.Bool("rootless", false, "slave: run unprivileged, with each job in a user namespace")
+	idmap          = flag.String("idmap", "single", "slave: rootless id mapping, single or subid")
+	rootMode       = flag.String("root", "", "run in the node's root with shipped files at their own paths: overlay or bind")
+	headroom       = flag.Int64("headroom", 64<<20, "bytes beyond the shipped files to allow in a job's staging tmpfs")
+	cgroupParent   = flag.String("cgroup", "", "slave: delegated cgroup v2 directory to put jobs in")
+	memMax         = flag.String("mem", "", "memory limit for the job on each node, e.g. 4G")
+	cpus           = flag.Float64("cpus", 0, "CPU limit for the job on each node, in cpus")
+	pidsMax        = flag.Int("pids", 0, "limit on the number of processes of the job on each node")
+	ioWeight       = flag.Int("ioweight", 0, "io weight of the job on each node, 1 to 10000")
+	timeLimit      = flag.String("time", "", "wall-clock limit for the job: seconds, 30m, 2h or H:M:S")
+	grace          = flag.String("grace", "10", "time between SIGTERM and SIGKILL when -time runs out")
+	launchTime     = flag.String("launchtime", "", "limit on getting the files to each node and starting the job there")
+	cpTime         = flag.String("cptime", "10m", "cp: limit on the copy on each node")
+	nice           = flag.Int("nice", 0, "niceness of the job's processes")
+	ioprio         = flag.String("ioprio", "", "I/O priority of the job's processes: rt, be or idle, with :LEVEL 0 to 7")
+	schedPolicy    = flag.String("sched", "", "scheduling policy of the job's processes: other, batch, idle, fifo:PRIO or rr:PRIO")
+	stageoutFiles  = flag.String("stageout", "", "comma-separated patterns of files in the job directory to bring back to ./<jobid>/<node>/")
+	stageoutMax    = flag.String("stageoutmax", "256M", "most stage-out data to take from each node")
+	stageoutTar    = flag.Bool("stageouttar", false, "write each node's stage-out files as ./<jobid>/<node>.tar")
+	lazy           = flag.Bool("lazy", false, "serve the files over 9P for the nodes to fetch as they are opened, instead of shipping them")
+	prefetch       = flag.String("prefetch", "", "with -lazy, comma-separated list of files to fetch before the job starts")
+	bundleFile     = flag.String("bundle", "", "launch from a file made by gproc pack instead of finding the files again")
+	include        = flag.String("include", "", "comma-separated globs of files to ship even if excluded")
+	exclude        = flag.String("exclude", "", "comma-separated globs of files not to ship")
+	nodeClass      = flag.String("class", "", "slave: class of node, for sharing the -provided manifest")
+	providedFile   = flag.String("provided", "", "slave: manifest in sha1sum format of files this node already has")
+)
 
-func (p *ProcVisitor) VisitDir(path string, f *os.FileInfo) bool {
-	return true
-}
-
-func (p *ProcVisitor) VisitFile(path string, f *os.FileInfo) {
-	dir, file := path.Split()
-	if f.IsRegular() {
-		file, err := os.Open(path, os.O_RDONLY)
-		if err != nil {
-			return
-		}
-		p.flist = append(flist, Acmd{dir, dir + file, 0, f, file})
-		p.totalbytes += f.size
-	}
-}
 
 func isNum(c int) bool {
 	return '0' < c && c < '9'
@@ -178,7 +219,7 @@ func waiter() {
  * we almost certainly exec it. Then we send all those
  * files right back out again to other nodes if needed
  * (later).
- * We always make and mount /tmp/xproc, and chdir to it, so the
+ * We always make and mount /tmp/xproc/<jobid>, and chdir to it, so the
  * programs have a safe place to stash files that might go away after
  * all is done.
  * Due to memory footprint issues, we really can not have both the
@@ -189,81 +230,186 @@ func waiter() {
  */
 func run() (err os.Error) {
 	var arg StartArg
-	var pathbase = "/tmp/xproc"
 	d := gob.NewDecoder(os.Stdin)
 	d.Decode(&arg)
-	/* make sure the directory exists and then do the private name space mount */
-
+	/* the socket to the slave, for the kvs; the job's processes are not to have it */
+	syscall.CloseOnExec(kvsFd)
 
+	/* stdout and stderr each get their own pipe, which we relay back
+	 * to the client a line at a time, tagged with this node. This is
+	 * first, so that whatever goes wrong after is reported.
+	 */
+	imp, err := netchan.NewImporter(arg.Lfam, arg.Lserver)
+	if err != nil {
+		return
+	}
+	wchan := make(chan cluster.IoData)
+	err = imp.Import("workerData", wchan, netchan.Send)
+	if err != nil {
+		return
+	}
+	schan := make(chan cluster.NodeStatus)
+	err = imp.Import("statusChan", schan, netchan.Send)
+	if err != nil {
+		return
+	}
 
-	os.Mkdir(pathbase, 0700)
+	pathbase := jobDir(arg.JobId)
+	defer cleanStage(pathbase)
+	/* lead our own process group, out of the slave's; what we start
+	 * leads groups of its own, so that kill can get at it without us
+	 */
+	syscall.Setpgid(0, 0)
+	/* make sure the directory exists and then do the private name space mount.
+	 * the slave has already cloned us into our own mount namespace.
+	 */
+	os.MkdirAll(pathbase, 0700)
+	lock, err := lockStage(pathbase)
+	if err != nil {
+		return runFailed(&arg, imp, wchan, schan, "stage", err)
+	}
+	defer lock.Close()
 	if DoPrivateMount == true {
-		unshare()
-		_ = unmount(pathbase)
-		err := privatemount(pathbase)
+		err = privateMount(pathbase, stageSize(arg.TotalFileBytes, arg.StageHeadroom))
 		if err != nil {
-			return
+			return runFailed(&arg, imp, wchan, schan, "mount", err)
 		}
 	}
-
-	for _, s := range arg.cmds {
-		_, err := writeitout(os.Stdin, s.name, s.fi)
+	/* the job's processes run as its user, who has to be able to write here */
+	if !*rootless {
+		err = os.Chown(pathbase, arg.Uid, arg.Gid)
 		if err != nil {
-			return
+			return runFailed(&arg, imp, wchan, schan, "stage", err)
 		}
 	}
+	err = setNodeHostname(&arg)
+	if err != nil {
+		return runFailed(&arg, imp, wchan, schan, "hostname", err)
+	}
 
-
-	n, err := connect(arg.Lserver)
+	files := filebase(&arg, pathbase)
+	os.MkdirAll(files, 0755)
+	/* setuid bits and capabilities only from root; they are root's on the
+	 * node. The uid is the one the master got from the kernel for the
+	 * client's socket (startjob), whatever the client put in its StartArg.
+	 */
+	x := &bundle.Extractor{Base: files, Privileged: arg.Uid == 0}
+	err = x.Extract(os.Stdin)
 	if err != nil {
-		return
+		return runFailed(&arg, imp, wchan, schan, "files", err)
+	}
+	arg.shipped = x.Files
+	if arg.Lazy {
+		err = mountLazy(&arg, pathbase, files)
+		if err != nil {
+			return runFailed(&arg, imp, wchan, schan, "lazy", err)
+		}
+	}
+	arg.newroot, err = setupRoot(&arg, pathbase)
+	if err != nil {
+		return runFailed(&arg, imp, wchan, schan, "root", err)
+	}
+	if arg.Root == "" {
+		arg.Env = setEnv(arg.Env, "LD_LIBRARY_PATH="+files+"/lib:"+files+"/lib64")
 	}
-	f := []*os.File{n, n, n}
 	execpath := pathbase + arg.Args[0]
-	if arg.LocalBin {
+	if arg.LocalBin || arg.Root != "" {
 		execpath = arg.Args[0]
 	}
-	_, err := os.ForkExec(execpath, arg.Args, arg.Env, pathbase, f)
-	n.Close()
+	/* the processes get their CPU binding from the thread that forks
+	 * them, so all the forks happen on this one.
+	 */
+	runtime.LockOSThread()
+	if arg.Tty {
+		in, err := stdinimport(imp, &arg, 0)
+		if err != nil {
+			return runFailed(&arg, imp, wchan, schan, "stdin", err)
+		}
+		arg.Env = procEnv(&arg, 0, 1, 0, 1)
+		status, err := runtty(&arg, imp, wchan, in, execpath, pathbase)
+		if arg.stagingOut() {
+			stageout(&arg, imp, pathbase)
+		}
+		endOutput(&arg, wchan)
+		schan <- nodeStatus(&arg, status)
+		return err
+	}
+	var ranks []int
+	if i := rankOf(arg.Nodes, arg.NodeId); i >= 0 {
+		ranks = arg.ranks()[i]
+	}
+	err = writeJobFiles(&arg, pathbase)
 	if err != nil {
-		return
+		log.Printf("job files: %v\n", err)
 	}
-	go waiter()
-	return
-}
-
-
-
-func writeitout(in *os.File, s string, fi os.FileInfo) (n int, err os.Error) {
-	out := "/tmp/xproc" + s
-
-	switch {
-	case fi.IsDir():
-		err = os.Mkdir(out, fi.Mode&0777)
+	if len(ranks) > 0 {
+		arg.pmisock, err = pmiserve(&arg, pathbase, len(ranks))
 		if err != nil {
-			return
+			log.Printf("no pmi: %v\n", err)
 		}
-	case fi.IsLink():
-		err = os.Symlink(out, "/tmp/xproc"+fi.Name)
+	}
+	var topo *topology
+	if arg.Bind == "core" || arg.Bind == "socket" {
+		topo, err = readTopology()
 		if err != nil {
-			return
+			log.Printf("no binding: %v\n", err)
 		}
-	case fi.IsRegular():
-		f, err := os.Open(out, os.O_RDWR|os.O_CREAT, 0777)
+	}
+	var wg sync.WaitGroup
+	var pids []int
+	status := 0
+	for i, r := range ranks {
+		pid, err := startproc(&arg, imp, wchan, topo, r, i, len(ranks), execpath, pathbase, &wg)
 		if err != nil {
-			return
+			log.Printf("rank %d: %v\n", r, err)
+			status = -1
+			continue
 		}
-		defer f.Close()
-		n, err := io.Copy(in, f)
+		pids = append(pids, pid)
+	}
+	timer := startTimer(arg.TimeLimit, arg.Grace, signalPids(pids))
+	for _, pid := range pids {
+		w, err := os.Wait(pid, 0)
+		switch {
+		case err != nil:
+			status = -1
+		case w.ExitStatus() != 0 && status == 0:
+			status = w.ExitStatus()
+		}
+	}
+	if timer.cancel() {
+		status = statusTimedOut
+	}
+	wg.Wait()
+	if arg.stagingOut() {
+		err = stageout(&arg, imp, pathbase)
 		if err != nil {
-			return
+			log.Printf("stage-out: %v\n", err)
 		}
-	default:
-		return
 	}
+	endOutput(&arg, wchan)
+	schan <- nodeStatus(&arg, status)
+	go waiter()
 	return
 }
 
+
+
+/* runFailed tells the client the job never got going on this node, and
+ * why, so that it isn't left waiting for the node.
+ */
+func runFailed(arg *StartArg, imp *netchan.Importer, wchan chan cluster.IoData, schan chan cluster.NodeStatus, what string, err os.Error) os.Error {
+	msg := fmt.Sprintf("%s: %v", what, err)
+	log.Printf("job %d: %s\n", arg.JobId, msg)
+	wchan <- cluster.IoData{JobId: arg.JobId, Node: arg.NodeId, Fd: 2, Data: []byte(msg + "\n")}
+	if arg.stagingOut() {
+		stageFailed(arg, imp, msg)
+	}
+	endOutput(arg, wchan)
+	schan <- cluster.NodeStatus{Node: arg.NodeId, Status: -1}
+	return err
+}
+
 func debuglevel(fam, server, newlevel string) (err os.Error) {
 	var ans SetDebugLevel
 	level, err := strconv.Atoi(newlevel)
@@ -279,40 +425,97 @@ func debuglevel(fam, server, newlevel string) (err os.Error) {
 	return
 }
 
-func MExec(arg *StartArg, exp netchan.Exporter) (err os.Error) {
+func MExec(arg *StartArg, dchan chan []byte, res chan Res) (err os.Error) {
 	/* suck in all the file data. Only the master need do this. */
-	dchan := chan []byte
-	err := exp.Export("filedata", dchan, netchan.Recv)
+	data := <-dchan
+	if closed(dchan) {
+		return
+	}
+	err = checkCaps(arg, &siteCaps)
 	if err != nil {
+		res <- Res{Msg: []byte(err.String())}
+		return
+	}
+	j := newJob(arg)
+	arg.JobId = j.Id
+	err = startKvs(j, arg)
+	if err == nil {
+		arg.JobFiles, err = jobFiles(arg)
+	}
+	if err != nil {
+		/* nothing has gone out yet; this takes the job off the books */
+		for _, n := range arg.Nodes {
+			j.failProc(n)
+		}
+		res <- Res{Msg: []byte(err.String()), JobId: j.Id}
 		return
 	}
-	data := <-dchan
 	/* this is explicitly for sending to remote nodes. So we actually just pick off one node at a time
 	 * and call execclient with it. Later we will group nodes.
 	 */
+	classData := make(map[string][]byte)
+	classSkipped := make(map[string]map[string]string)
+	var failed []string
 	for _, n := range arg.Nodes {
 		s, ok := Slaves[n]
 		if !ok {
+			j.failProc(n)
+			failed = append(failed, n)
 			continue
 		}
-		s.ch <- arg
+		d, ok := classData[s.Class]
+		if !ok {
+			var skipped map[string]string
+			d, skipped, err = stripProvided(data, classProvided(s.Class), arg.Root != "")
+			if err != nil {
+				log.Printf("job %d: %v\n", j.Id, err)
+				d, skipped = data, nil
+			}
+			if DebugLevel > 0 && len(skipped) > 0 {
+				log.Printf("job %d: %d files already on class %s nodes\n", j.Id, len(skipped), s.Class)
+			}
+			classData[s.Class], classSkipped[s.Class] = d, skipped
+		}
+		a := *arg
+		a.Provided = classSkipped[s.Class]
+		r, err := launch(s, &a, d, arg.LaunchTimeout)
+		if err == nil && r.Stale {
+			log.Printf("job %d node %s: %s\n", j.Id, n, r.Msg)
+			setProvided(s.Class, s.id, nil)
+			a.Provided = nil
+			r, err = launch(s, &a, data, arg.LaunchTimeout)
+		}
 		if err != nil {
+			log.Printf("job %d node %s: %v\n", j.Id, n, err)
+			/* in case it got as far as starting */
+			s.kch <- KillArg{JobId: j.Id, Sig: syscall.SIGKILL}
+			j.procExit(ProcExit{JobId: j.Id, Node: n, Status: statusTimedOut})
+			failed = append(failed, n)
+			continue
+		}
+		if r.Pid <= 0 {
+			log.Printf("job %d node %s: %s\n", j.Id, n, r.Msg)
+			j.failProc(n)
+			failed = append(failed, n)
 			continue
 		}
-		s.dch <- data
+		j.setProc(n, r.Pid)
 	}
-	res <- Res{Msg: []byte("Message: I care")}
+	j.startTimer(arg.TimeLimit, arg.Grace)
+	/* the client hears nothing from these nodes otherwise */
+	res <- Res{Msg: []byte(fmt.Sprintf("job %d", j.Id)), JobId: j.Id, Failed: failed}
 	return
 }
 
 func newSlave(arg *SlaveArg, e *netchan.Exporter) (res SlaveRes, err os.Error) {
-	s := SlaveInfo{Addr: arg.a, client: e}
-	if arg.id == "-1" {
+	s := SlaveInfo{Addr: arg.HostAddr, Host: arg.Host, Class: arg.Class, client: e}
+	if arg.Id == "-1" {
 		s.id = fmt.Sprintf("%d", len(Slaves)+1)
 	} else {
-		s = Slaves[arg.id]
+		s = Slaves[arg.Id]
 	}
-	res.id = s.id
+	setProvided(arg.Class, s.id, arg.Provided)
+	res.Id = s.id
 	Slaves[s.id] = s
 	return
 }
@@ -329,18 +532,14 @@ func master(addr string) (err os.Error) {
 	if err != nil {
 		return
 	}
-	go func(achan chan StartArg) {
-		for {
-			a := <-achan
-			/*
-				_, uid, gid := ucred(0)
-				a.uid = uid
-				a.gid = gid
-			*/
-			go MExec(&a, achan)
-		}
+	echan := make(chan ProcExit)
+	err = e.Export("exitChan", echan, netchan.Recv)
+	if err != nil {
 		return
-	}(e)
+	}
+	go jobexits(echan)
+	go ctlserver(addr)
+	go jobserver(addr)
 	nete, err := netchan.NewExporter("tcp4", "0.0.0.0:0")
 	if err != nil {
 		return
@@ -354,7 +553,7 @@ func master(addr string) (err os.Error) {
 	for {
 		s := <-achan
 		rchan := make(chan SlaveRes)
-		imp, err := NewImporter(s.fam, s.addr)
+		imp, err := netchan.NewImporter("tcp4", s.Addr)
 		if err != nil {
 			return
 		}
@@ -362,14 +561,55 @@ func master(addr string) (err os.Error) {
 		if err != nil {
 			return
 		}
+		kch := make(chan KillArg)
+		err = imp.Import("killChan", kch, netchan.Send)
+		if err != nil {
+			return
+		}
+		cpch := make(chan CpArg)
+		err = imp.Import("cpChan", cpch, netchan.Send)
+		if err != nil {
+			return
+		}
+		cprch := make(chan CpRes)
+		err = imp.Import("cpResChan", cprch, netchan.Recv)
+		if err != nil {
+			return
+		}
+		/* the slave's answer to each launch */
+		rch := make(chan Res)
+		err = imp.Import("jobResChan", rch, netchan.Recv)
+		if err != nil {
+			return
+		}
+		/* the kvs fences of its jobs, and the key spaces back */
+		kvsf := make(chan KvsFence)
+		err = imp.Import("kvsFenceChan", kvsf, netchan.Recv)
+		if err != nil {
+			return
+		}
+		kvsd := make(chan KvsData)
+		err = imp.Import("kvsDataChan", kvsd, netchan.Send)
+		if err != nil {
+			return
+		}
+		go kvsmaster(kvsf)
 		r, err := newSlave(&s, e)
+		si := Slaves[r.Id]
+		si.rch = rch
+		si.kch = kch
+		si.cpch, si.cprch = cpch, cprch
+		si.cplock = new(sync.Mutex)
+		si.ldlock = new(sync.Mutex)
+		si.kvsd = kvsd
+		Slaves[r.Id] = si
 		rchan <- r
 	}
 	return
 }
 
 /* rexec will create a listener and then relay the results. We do this go get an IO hierarchy. */
-func RExec(arg *StartArg, datachan chan []byte) (res Res, err os.Error) {
+func RExec(arg *StartArg, datachan chan []byte, echan chan ProcExit, kvsf chan KvsFence) (res Res, err os.Error) {
 	r, w, err := os.Pipe()
 	defer r.Close()
 	defer w.Close()
@@ -379,16 +619,80 @@ func RExec(arg *StartArg, datachan chan []byte) (res Res, err os.Error) {
 	if err != nil {
 		return
 	}
+	err = rootlessCheck(arg)
+	if err != nil {
+		res.Msg = []byte(err.String())
+		return
+	}
+	if f := checkProvided(arg.Provided); f != "" {
+		res.Msg = []byte("provided: " + f + " has changed")
+		res.Stale = true
+		return
+	}
 	bugger := fmt.Sprintf("-debug=%d", DebugLevel)
 	private := fmt.Sprintf("-p=%v", DoPrivateMount)
-	pid, err := os.ForkExec("./gproc", []string{"gproc", bugger, private, "R"}, []string{""}, ".", []*os.File{r, w, w})
+	args := []string{"gproc", bugger, private, "R"}
+	kvs, kvsr, err := kvsPair()
 	if err != nil {
 		return
 	}
-	
-	go waiter()
+	defer kvsr.Close()
+	files := []*os.File{r, w, w, kvsr}
+	/* a runner that gets its maps after it starts waits for them on fd 4 */
+	var mapr, mapw *os.File
+	if idmapAfter() {
+		mapr, mapw, err = os.Pipe()
+		if err != nil {
+			return
+		}
+		defer mapw.Close()
+		args = append(args, "idmap")
+		files = append(files, mapr)
+	}
+	p, err := os.StartProcess("./gproc", args, &os.ProcAttr{
+		Dir:   ".",
+		Env:   []string{""},
+		Files: files,
+		Sys:   runnerSysProcAttr(arg),
+	})
+	if mapr != nil {
+		mapr.Close()
+	}
+	if err != nil {
+		kvs.Close()
+		return
+	}
+	go kvsrelay(arg.JobId, kvs, kvsf)
+	pid := p.Pid
+	err = idmapRunner(pid)
+	if err != nil {
+		p.Kill()
+		res.Msg = []byte(err.String())
+		return
+	}
+	if mapw != nil {
+		mapw.Close()
+	}
+	/* whatever came in it, the runner finds its usage here */
+	arg.Cgroup, err = newCgroup(arg, pid)
+	if err != nil {
+		arg.Cgroup = ""
+		if arg.Limits.Any() {
+			p.Kill()
+			res.Msg = []byte("cgroup: " + err.String())
+			return
+		}
+		log.Printf("job %d runs without a cgroup: %v\n", arg.JobId, err)
+		err = nil
+	}
+	res.Node = NodeId
+	res.Pid = pid
+
+	go procwait(arg.JobId, pid, arg.Cgroup, echan)
 
 	/* relay data to the child */
+	arg.NodeId = NodeId
+	arg.MasterFam, arg.MasterAddr = MasterFam, MasterAddr
 	e := gob.NewEncoder(w)
 	e.Encode(arg)
 	for (b := <-datachan) != nil {
@@ -420,7 +724,64 @@ func slave(rfam, raddr string) (err os.Error) {
 
 
 
-	schan <- SlaveArg{id: "-1"}
+	/* the master calls back in here to signal our jobs and copy files */
+	kexp, err := netchan.NewExporter("tcp4", "0.0.0.0:0")
+	if err != nil {
+		return
+	}
+	kch := make(chan KillArg)
+	err = kexp.Export("killChan", kch, netchan.Recv)
+	if err != nil {
+		return
+	}
+	go slavekill(kch)
+	cpch := make(chan CpArg)
+	err = kexp.Export("cpChan", cpch, netchan.Recv)
+	if err != nil {
+		return
+	}
+	cprch := make(chan CpRes)
+	err = kexp.Export("cpResChan", cprch, netchan.Send)
+	if err != nil {
+		return
+	}
+	go slavecp(cpch, cprch)
+	jrch := make(chan Res)
+	err = kexp.Export("jobResChan", jrch, netchan.Send)
+	if err != nil {
+		return
+	}
+	kvsf := make(chan KvsFence)
+	err = kexp.Export("kvsFenceChan", kvsf, netchan.Send)
+	if err != nil {
+		return
+	}
+	kvsd := make(chan KvsData)
+	err = kexp.Export("kvsDataChan", kvsd, netchan.Recv)
+	if err != nil {
+		return
+	}
+	go kvsslave(kvsd)
+	echan := make(chan ProcExit)
+	err = imp.Import("exitChan", echan, netchan.Send)
+	if err != nil {
+		return
+	}
+
+	host, _ := os.Hostname()
+	haddr := hostAddr(rfam, raddr)
+	_, port, err := net.SplitHostPort(kexp.Addr().String())
+	if err != nil {
+		return
+	}
+	var have map[string]string
+	if *providedFile != "" {
+		have, err = loadProvided(*providedFile)
+		if err != nil {
+			log.Printf("provided: %v\n", err)
+		}
+	}
+	schan <- SlaveArg{Id: "-1", Addr: net.JoinHostPort(haddr, port), HostAddr: haddr, Host: host, Class: *nodeClass, Provided: have}
 	anschan := make(chan SlaveArg)
 	err = imp.Import("argChan", anschan, netchan.Recv)
 	if err != nil {
@@ -428,6 +789,8 @@ func slave(rfam, raddr string) (err os.Error) {
 	}
 
 	ans := <-anschan
+	NodeId = ans.Id
+	MasterFam, MasterAddr = rfam, raddr
 	for {
 		var res Res
 		achan := make(chan StartArg)
@@ -437,13 +800,34 @@ func slave(rfam, raddr string) (err os.Error) {
 		 * RExec will ForkExec and do that.
 		 */
 		datachan := make(chan []byte)
-		rchan := make(chan Res)
-		imp.Import("resChan", rchan, netchan.Send)
-		
-		rchan <- RExec(&arg, datachan)
+		res, err = RExec(&arg, datachan, echan, kvsf)
+		if err != nil && res.Msg == nil {
+			res.Msg = []byte(err.String())
+		}
+		jrch <- res
 	}
 }
 
+/* hostAddr is this node's address on the way to the master at raddr:
+ * the source address the kernel picks to reach it. The kill exporter
+ * listens on all of them, and 0.0.0.0 is no use to anyone else.
+ */
+func hostAddr(rfam, raddr string) string {
+	if rfam != "tcp" && rfam != "tcp4" && rfam != "tcp6" {
+		return "127.0.0.1"
+	}
+	/* nothing is sent on a udp dial; it only picks a route */
+	c, err := net.Dial("udp"+rfam[3:], "", raddr)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer c.Close()
+	if a, ok := c.LocalAddr().(*net.UDPAddr); ok {
+		return a.IP.String()
+	}
+	return "127.0.0.1"
+}
+
 func readConfig(configCanditates []string) (config gpconfig, err os.Error) {
 	for _, cfg := range configCanditates {
 		configdata, _ := ioutil.ReadFile(cfg)
@@ -463,113 +847,203 @@ func setLogFile(logfile string) (err os.Error) {
 	log.SetOutput(logfile)
 }
 
-func iowaiter(fam, server string, nw int) (workers chan int, err os.Error) {
-	exp, err := netchan.NewExporter(fam, server)
-	if err != nil {
-		return
+/* exec is gproc e: the flags make a cluster.JobSpec, and a Launcher does
+ * the rest. Everything the command line can say a program can say to
+ * the Launcher too.
+ */
+func exec(a []string) (status int) {
+	var pk *Pack
+	if *bundleFile != "" {
+		if *lazy {
+			log.Exit("-bundle and -lazy don't go together")
+		}
+		var err os.Error
+		pk, err = openPack(*bundleFile)
+		if err != nil {
+			log.Exit(err)
+		}
+		defer pk.Close()
+		if len(a) == 5 {
+			a = append(a, pk.Args...)
+		}
+	}
+	spec := cluster.JobSpec{
+		Args:           a[5:],
+		Env:            exportEnv(*exportMode),
+		EnvTemplates:   envSettings,
+		Nodes:          NodeList(a[4]),
+		Np:             *np,
+		Ppn:            *ppn,
+		Dist:           *dist,
+		Bind:           *bind,
+		HostfileFormat: *hostfile,
+		Namespaces:     *namespaces,
+		Hostname:       *nsHostname,
+		Root:           *rootMode,
+		Headroom:       *headroom,
+		Rlimits:        rlimitSettings,
+		Nice:           *nice,
+	}
+
+	t := &spec.Takeout
+	t.LocalBin = localbin
+	t.Lazy = *lazy
+	t.Hide = func(name string) bool { return takeoutRules.skip(name) }
+	cmdFile := a[5]
+	switch {
+	case pk != nil:
+		/* it has all been found already */
+		var data bytes.Buffer
+		err := pk.writeBundle(&data)
+		if err != nil {
+			log.Exit(err)
+		}
+		t.Bundle = data.Bytes()
+	case *lazy:
+		t.Files = strings.Split(takeout, ",", -1)
+		if !localbin {
+			libpath := strings.Split(libs, ":", -1)
+			e, _ := ldd.Ldd(cmdFile, root, libpath)
+			t.Files = append(t.Files, e...)
+			t.Files = append(t.Files, cmdFile)
+			t.Prefetch = append(t.Prefetch, cmdFile)
+		}
+	default:
+		t.Entries = packEntries(discover(a[5:], strings.Split(takeout, ",", -1), localbin))
 	}
-	wchan := make(chan []byte)
-	err = exp.Export("workerData", wchan, netchan.Recv)
+	if *prefetch != "" {
+		t.Prefetch = append(t.Prefetch, strings.Split(*prefetch, ",", -1)...)
+	}
+
+	err := checkHostfileFormat(*hostfile)
 	if err != nil {
-		return
+		log.Exit(err)
 	}
-	workers = make(chan int, nw)
-	err = exp.Export("statusChan", workers, netchan.Recv)
+	err = checkNamespaces(*namespaces)
 	if err != nil {
-		return
+		log.Exit(err)
 	}
-	go func() {
-		select {
-		case data := <-wchan:
-			os.Stdout.Write(data)
-		case status := <-workers:
-			nw--
-			if nw >= 0 {
-				return
-			}
-		}
-	}()
-	return
-}
-
-func exec() {
-	var cmds ProcVisitor
-
-	for _, s := range strings.Split(takeout, ",", -1) {
-		path.Walk(s, &cmds, nil)
+	err = checkRoot(*rootMode)
+	if err != nil {
+		log.Exit(err)
 	}
-	cmdFile := flag.Arg(5)
-	libpath := strings.Split(libs, ":", -1)
-	e, _ := ldd.Ldd(cmdFile, root, libpath)
-	if !localbin {
-		for _, s := range e {
-			path.Walk(s, &cmds, nil)
-		}
+	mem, err := parseSize(*memMax)
+	if err != nil {
+		log.Exit(err)
 	}
-
-	fam := flag.Arg(2)
-	raddr := flag.Arg(3)
-	workers, l := iowaiter(fam, raddr, len(flag.Arg(4)))
-	nodes := NodeList(flag.Arg(4))
-	server := flag.Arg(1)
-	args := flag.Args()[5:]
-	peers := []string{}
-	for _, c := range cmds {
-		defer c.file.Close()
+	spec.Limits = cluster.Limits{MemMax: mem, Cpus: *cpus, PidsMax: *pidsMax, IoWeight: *ioWeight}
+	spec.TimeLimit, err = parseTime(*timeLimit)
+	if err != nil {
+		log.Exit(err)
 	}
-	imp, err := netchan.NewImporter("unix", server)
+	spec.Grace, err = parseTime(*grace)
 	if err != nil {
-		return
+		log.Exit(err)
 	}
-	sachan := make(chan StartArg)
-	err = imp.Import("startArgChan", sachan, netchan.Send)
+	spec.LaunchTimeout, err = parseTime(*launchTime)
 	if err != nil {
-		return
+		log.Exit(err)
 	}
-	achan <- StartArg{
-		Lfam:           lfam,
-		Lserver:        laddr,
-		cmds:           nil,
-		LocalBin:       localbin,
-		totalfilebytes: cmds.totalbytes,
-		Args:           args,
-		Env:            []string{"LD_LIBRARY_PATH=/tmp/xproc/lib:/tmp/xproc/lib64"},
-		Nodes:          nodes,
-		cmds:           cmds,
+	if *ioprio != "" {
+		spec.IoClass, spec.IoLevel, err = parseClass(*ioprio, ioClasses)
+		if err != nil {
+			log.Exit(err)
+		}
 	}
-	for _, c := range cmd {
-		// this is going to take some effort, the channel is going to require a bit more.
-		err = io.Copy(c.file, client)
+	if *schedPolicy != "" {
+		spec.Policy, spec.Priority, err = parseClass(*schedPolicy, schedPolicies)
 		if err != nil {
-			return
+			log.Exit(err)
 		}
 	}
-	rchan := make(chan Res)
-	exp, err := netchan.NewExporter(lfam, laddr)
+	err = checkSched(&spec)
 	if err != nil {
-		return
+		log.Exit(err)
 	}
-	imp.Export("resChan", rchan, netchan.Recv)
-	r = <-rchan
 
-	nworkers := len(nodes) + len(peers)
-	for ; nworkers > 0; nworkers-- {
-		<-workers
+	o := &spec.IO
+	o.Stdin = os.Stdin
+	o.StdinMode = *stdinMode
+	o.Tty = *tty
+	o.Raw = *rawio
+	if *stageoutFiles != "" {
+		o.StageOut = strings.Split(*stageoutFiles, ",", -1)
+	}
+	o.StageOutMax, err = parseSize(*stageoutMax)
+	if err != nil {
+		log.Exit(err)
+	}
+	o.StageDir = "."
+	o.StageTar = *stageoutTar
+	if *nodeRedirect {
+		/* otherwise newOutputter does -o and -e here */
+		o.StdoutFile, o.StderrFile = *stdoutTemplate, *stderrTemplate
+	}
+	var out outputter
+	if *tty {
+		o.Output = func(d cluster.IoData) { os.Stdout.Write(d.Data) }
+	} else {
+		out = newOutputter(cluster.JobSize(spec.Nodes, spec.Np, spec.Ppn, spec.Dist))
+		o.Output = func(d cluster.IoData) { out.write(d) }
+	}
+
+	l := &cluster.Launcher{Master: a[1], Fam: a[2], Addr: a[3]}
+	j, err := l.Launch(context.Background(), spec)
+	if err != nil {
+		log.Exit(err)
+	}
+	status, err = j.Wait()
+	if out != nil {
+		out.flush()
+	}
+	if err != nil {
+		log.Print(err)
 	}
+	for _, s := range j.Status() {
+		if s.MemPeak > 0 || s.CpuUsec > 0 {
+			log.Printf("node %s: status %d mem %d cpu %d.%06ds\n", s.Node, s.Status, s.MemPeak, s.CpuUsec/1e6, s.CpuUsec%1e6)
+		}
+	}
+	if status == statusTimedOut {
+		log.Print("job timed out\n")
+	}
+	return
 }
 
 
+func init() {
+	flag.Var(&envSettings, "env", "KEY=VAL to set in the remote environment, %j %n %r %h expand per rank; may be repeated")
+	flag.Var(&rlimitSettings, "rlimit", "NAME=CUR[:MAX] resource limit for the job's processes, e.g. stack=unlimited; may be repeated")
+}
+
 func main() {
 	var takeout, root, libs string
 	var config gpconfig
 	Slaves = make(map[string]SlaveInfo, 1024)
 	errchan = make(chan os.Error)
 
+	/* the init of a job's pid namespace, the step before each of its
+	 * processes and the cp child take no flags or config, and may not
+	 * be able to write the log
+	 */
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "I":
+			os.Exit(initproc(os.Args[2:]))
+		case "P":
+			os.Exit(prepproc(os.Args[2:]))
+		case "C":
+			os.Exit(cphelper())
+		}
+	}
 	config, err := readConfig([]string{"gpconfig", "/etc/clustermatic/gpconfig"})
 	if err != nil {
 		log.Exit(err)
 	}
 	flag.Parse()
+	siteCaps = config.Caps
+	takeoutRules = config.Takeout
+	takeoutRules.add(*include, *exclude)
 	err = setLogfile(Logfile)
 	if err != nil {
 		log.Exit(err)
@@ -592,14 +1066,81 @@ func main() {
 		if len(flag.Args()) < 3 {
 			log.Exitf("Usage: %s s <family> <address>\n", os.Args[0])
 		}
+		if *rootless {
+			err = rootlessOK()
+			if err != nil {
+				log.Exit(err)
+			}
+		}
+		sweepStage()
 		slave(flag.Arg(1), flag.Arg(2))
 	case "e":
-		if len(flag.Args()) < 6 {
+		if len(flag.Args()) < 6 && !(*bundleFile != "" && len(flag.Args()) == 5) {
 			log.Exitf("Usage: %s e  <server address> <fam> <address> <nodes> <command>\n", os.Args[0])
 		}
-		exec()
+		if *tty {
+			*stdinMode = "all"
+		}
+		os.Exit(exec(flag.Args()))
+	case "sh":
+		if len(flag.Args()) < 5 {
+			log.Exitf("Usage: %s sh <server address> <fam> <address> <node> [command]\n", os.Args[0])
+		}
+		a := flag.Args()
+		if len(a) == 5 {
+			a = append(a, "/bin/sh")
+			*localbin = true
+		}
+		*tty = true
+		*stdinMode = "all"
+		os.Exit(exec(a))
 	case "R":
+		if flag.Arg(1) == "idmap" {
+			idmapWait()
+		}
 		run()
+	case "pack":
+		err = packcmd(flag.Args()[1:])
+		if err != nil {
+			log.Exit(err)
+		}
+	case "unpack":
+		if len(flag.Args()) < 3 {
+			log.Exitf("Usage: %s unpack <pack file> <directory>\n", os.Args[0])
+		}
+		err = unpackcmd(flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			log.Exit(err)
+		}
+	case "inspect":
+		if len(flag.Args()) < 2 {
+			log.Exitf("Usage: %s inspect <pack file>\n", os.Args[0])
+		}
+		err = inspectcmd(flag.Arg(1))
+		if err != nil {
+			log.Exit(err)
+		}
+	case "ps":
+		if len(flag.Args()) < 2 {
+			log.Exitf("Usage: %s [-l] ps <server address>\n", os.Args[0])
+		}
+		err = jobps(flag.Arg(1))
+		if err != nil {
+			log.Exit(err)
+		}
+	case "cp":
+		if len(flag.Args()) < 4 {
+			log.Exitf("Usage: %s cp [-r] <server address> SRC... NODES:DEST | NODES:SRC DEST\n", os.Args[0])
+		}
+		os.Exit(copyfiles(flag.Args()[1:]))
+	case "kill":
+		if len(flag.Args()) < 3 {
+			log.Exitf("Usage: %s [-s SIG] kill <server address> JOBID[.NODE]\n", os.Args[0])
+		}
+		err = jobkill(flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			log.Exit(err)
+		}
 	default:
 		for _, s := range flag.Args() {
 			fmt.Print(s, " ")
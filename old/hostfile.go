@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"json"
+	"os"
+	"path"
+)
+
+/* mpirun, Spark, Horovod and their friends want to be told where
+ * everything is in a file. The master, which knows every node's name
+ * and address, writes them for each job and they travel in the StartArg;
+ * the runner drops them in /tmp/xproc and points at them from the
+ * environment:
+ *	GPROC_HOSTFILE	one entry per node, in the format -hostfile asks for:
+ *			plain	the host once for each rank on it
+ *			mpich	host:nranks
+ *			openmpi	host slots=nranks
+ *	GPROC_RANKMAP	a JSON list of ranks with node, host, address and local rank
+ *	GPROC_NODEFILE	the hosts of the job, one per line
+ */
+
+type RankInfo struct {
+	Rank      int
+	Node      string
+	Host      string
+	Addr      string
+	LocalRank int
+}
+
+const (
+	hostfileName = "hostfile"
+	rankmapName  = "rankmap.json"
+	nodefileName = "nodes"
+)
+
+func checkHostfileFormat(format string) os.Error {
+	switch format {
+	case "plain", "mpich", "openmpi":
+		return nil
+	}
+	return os.NewError("unknown -hostfile format " + format)
+}
+
+/* jobFiles makes the files for a job. It runs on the master. */
+func jobFiles(arg *StartArg) (files map[string][]byte, err os.Error) {
+	var hosts, nodes bytes.Buffer
+	var ranks []RankInfo
+	for i, r := range arg.ranks() {
+		if len(r) == 0 {
+			continue
+		}
+		n := arg.Nodes[i]
+		host, addr := n, ""
+		if s, ok := Slaves[n]; ok {
+			addr = s.Addr
+			if s.Host != "" {
+				host = s.Host
+			}
+		}
+		switch arg.HostfileFormat {
+		case "mpich":
+			fmt.Fprintf(&hosts, "%s:%d\n", host, len(r))
+		case "openmpi":
+			fmt.Fprintf(&hosts, "%s slots=%d\n", host, len(r))
+		default:
+			for _ = range r {
+				fmt.Fprintf(&hosts, "%s\n", host)
+			}
+		}
+		fmt.Fprintf(&nodes, "%s\n", host)
+		for l, rank := range r {
+			ranks = append(ranks, RankInfo{Rank: rank, Node: n, Host: host, Addr: addr, LocalRank: l})
+		}
+	}
+	/* with -dist cyclic the ranks of a node aren't contiguous, so put them in order */
+	byRank := make([]RankInfo, len(ranks))
+	for _, r := range ranks {
+		byRank[r.Rank] = r
+	}
+	rankmap, err := json.MarshalIndent(byRank, "", "\t")
+	if err != nil {
+		return
+	}
+	files = map[string][]byte{
+		hostfileName: hosts.Bytes(),
+		rankmapName:  rankmap,
+		nodefileName: nodes.Bytes(),
+	}
+	return
+}
+
+/* writeJobFiles puts the job's files in pathbase on the node and adds
+ * their names to the environment.
+ */
+func writeJobFiles(arg *StartArg, pathbase string) (err os.Error) {
+	env := map[string]string{
+		hostfileName: "GPROC_HOSTFILE",
+		rankmapName:  "GPROC_RANKMAP",
+		nodefileName: "GPROC_NODEFILE",
+	}
+	for name, data := range arg.JobFiles {
+		p := path.Join(pathbase, name)
+		f, err := os.Open(p, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if v, ok := env[name]; ok {
+			arg.Env = setEnv(arg.Env, v+"="+p)
+		}
+	}
+	return
+}
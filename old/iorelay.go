@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* Output from the remote processes goes back to the client as
+ * cluster.IoData, a line at a time unless the job is raw, so output
+ * from different nodes never gets mixed up mid-line at the client.
+ */
+
+/* the largest chunk of a single line we hold on to before we send it anyway */
+const maxLine = 64 * 1024
+
+/* relay copies r to the client as messages like d, a line at a time
+ * unless raw is set.
+ */
+func relay(d cluster.IoData, raw bool, r io.Reader, wchan chan cluster.IoData, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() { wchan <- d }()
+	if raw {
+		for {
+			b := make([]byte, 8192)
+			n, err := r.Read(b)
+			if n > 0 {
+				d.Data = b[:n]
+				wchan <- d
+				d.Data = nil
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	br, err := bufio.NewReaderSize(r, maxLine)
+	if err != nil {
+		return
+	}
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			d.Data = make([]byte, len(line))
+			copy(d.Data, line)
+			wchan <- d
+			d.Data = nil
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+/* endOutput tells the client that this node has sent all its output.
+ * It goes just before the node's status, which the client may get first.
+ */
+func endOutput(arg *StartArg, wchan chan cluster.IoData) {
+	wchan <- cluster.IoData{JobId: arg.JobId, Node: arg.NodeId}
+}
+
+/* ioprint writes a message from a remote process to our own stdout or
+ * stderr, as it was on the node, prefixing each line with the node if
+ * label is set.
+ */
+func ioprint(d cluster.IoData, label bool) (err os.Error) {
+	out := os.Stdout
+	if d.Fd == 2 {
+		out = os.Stderr
+	}
+	if !label {
+		_, err = out.Write(d.Data)
+		return
+	}
+	prefix := []byte("[" + d.Src + "] ")
+	var b bytes.Buffer
+	for _, l := range bytes.SplitAfter(d.Data, []byte{'\n'}, -1) {
+		if len(l) == 0 {
+			continue
+		}
+		b.Write(prefix)
+		b.Write(l)
+	}
+	if d.Data[len(d.Data)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	_, err = out.Write(b.Bytes())
+	return
+}
+
+/* labelio decides whether output gets a [node] prefix for a job of size processes. */
+func labelio(size int) bool {
+	switch {
+	case *rawio, *nolabel:
+		return false
+	case *label:
+		return true
+	}
+	return size > 1
+}
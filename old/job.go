@@ -0,0 +1,591 @@
+package main
+
+import (
+	"fmt"
+	"gob"
+	"io/ioutil"
+	"log"
+	"net"
+	"netchan"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* The master hands out a job ID for every MExec and keeps a record of
+ * what it launched: who asked, what they ran, where it went and what
+ * became of it on each node. ps and kill come in over a separate unix
+ * socket next to the master's, so we can ask the kernel who is on the
+ * other end instead of believing what the client tells us.
+ */
+
+type JobProc struct {
+	Node    string
+	Pid     int
+	State   string
+	Status  int
+	MemPeak int64
+	CpuUsec int64
+}
+
+type Job struct {
+	Id       int
+	Uid, Gid int
+	Args     []string
+	Nodes    []string
+	Start    int64
+	State    string
+	Procs    map[string]*JobProc
+	done     chan bool
+	timer    *jobTimer
+}
+
+/* sent from the master to a slave to signal the processes of a job */
+type KillArg struct {
+	JobId int
+	Sig   int
+}
+
+/* sent from a slave to the master when one of its processes goes away */
+type ProcExit struct {
+	JobId   int
+	Node    string
+	Pid     int
+	Status  int
+	MemPeak int64
+	CpuUsec int64
+}
+
+type CtlArg struct {
+	Cmd   string
+	Long  bool
+	JobId int
+	Node  string
+	Sig   int
+	Nodes []string
+	Cp    CpArg
+}
+
+type CtlRes struct {
+	Msg []byte
+	Err string
+	Cp  []CpRes
+}
+
+var (
+	jobLock   sync.Mutex
+	Jobs      = make(map[int]*Job)
+	lastJobId int
+)
+
+var sigNames = map[string]int{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
+
+func newJob(arg *StartArg) *Job {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	lastJobId++
+	j := &Job{
+		Id:    lastJobId,
+		Uid:   arg.Uid,
+		Gid:   arg.Gid,
+		Args:  arg.Args,
+		Nodes: arg.Nodes,
+		Start: time.Seconds(),
+		State: "starting",
+		Procs: make(map[string]*JobProc, len(arg.Nodes)),
+		done:  make(chan bool),
+	}
+	for _, n := range arg.Nodes {
+		j.Procs[n] = &JobProc{Node: n, State: "starting"}
+	}
+	Jobs[j.Id] = j
+	return j
+}
+
+func (j *Job) setProc(node string, pid int) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	p, ok := j.Procs[node]
+	if !ok {
+		return
+	}
+	p.Pid = pid
+	p.State = "running"
+	j.State = "running"
+}
+
+/* a node we could not reach never gets a process, mark it so it does not
+ * hold the job open forever.
+ */
+func (j *Job) failProc(node string) {
+	j.procExit(ProcExit{JobId: j.Id, Node: node, Status: -1})
+}
+
+func (j *Job) procExit(e ProcExit) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	/* a report can come in after MExec has given up on the node and
+	 * finished the job; done is closed only once
+	 */
+	if j.State == "done" || j.State == "timedout" {
+		return
+	}
+	p, ok := j.Procs[e.Node]
+	if !ok {
+		return
+	}
+	p.Status = e.Status
+	p.MemPeak = e.MemPeak
+	p.CpuUsec = e.CpuUsec
+	p.State = "exited"
+	switch {
+	case e.Status == statusTimedOut || j.timer != nil && j.timer.fired():
+		p.State = "timedout"
+		p.Status = statusTimedOut
+	case e.Status < 0:
+		p.State = "failed"
+	}
+	for _, p := range j.Procs {
+		if p.State == "starting" || p.State == "running" {
+			return
+		}
+	}
+	j.State = "done"
+	if j.timer != nil && j.timer.cancel() {
+		j.State = "timedout"
+	}
+	close(j.done)
+	if DebugLevel > 1 {
+		log.Printf("job %d done\n", j.Id)
+	}
+	Jobs[j.Id] = j, false
+}
+
+/* jobexits reads process exit reports from all the slaves. */
+func jobexits(echan chan ProcExit) {
+	for {
+		e := <-echan
+		jobLock.Lock()
+		j, ok := Jobs[e.JobId]
+		jobLock.Unlock()
+		if !ok {
+			continue
+		}
+		j.procExit(e)
+	}
+}
+
+/* startTimer puts the job on the clock once it has been launched. */
+func (j *Job) startTimer(limit, grace int64) {
+	t := startTimer(limit, grace, func(sig int) {
+		if DebugLevel > 0 {
+			log.Printf("job %d out of time, signal %d\n", j.Id, sig)
+		}
+		j.signal(j.Nodes, sig)
+	})
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	if j.State == "done" {
+		t.cancel()
+		return
+	}
+	j.timer = t
+}
+
+/* signal has the slaves on nodes send sig to everything of the job's they run. */
+func (j *Job) signal(nodes []string, sig int) {
+	for _, n := range nodes {
+		s, ok := Slaves[n]
+		if !ok {
+			continue
+		}
+		s.kch <- KillArg{JobId: j.Id, Sig: sig}
+	}
+}
+
+func (j *Job) owned(uid int) bool {
+	return uid == 0 || uid == j.Uid
+}
+
+func (j *Job) format(long bool) string {
+	s := fmt.Sprintf("%-6d %-6d %-9s %-10d %-8d %s\n", j.Id, j.Uid, j.State,
+		j.Start, len(j.Nodes), strings.Join(j.Args, " "))
+	if !long {
+		return s
+	}
+	nodes := make([]string, 0, len(j.Procs))
+	for n := range j.Procs {
+		nodes = append(nodes, n)
+	}
+	sort.SortStrings(nodes)
+	for _, n := range nodes {
+		p := j.Procs[n]
+		s += fmt.Sprintf("\t%d.%s pid %d %s %d", j.Id, n, p.Pid, p.State, p.Status)
+		if p.MemPeak > 0 || p.CpuUsec > 0 {
+			s += fmt.Sprintf(" mem %d cpu %d.%06ds", p.MemPeak, p.CpuUsec/1e6, p.CpuUsec%1e6)
+		}
+		s += "\n"
+	}
+	return s
+}
+
+/* JOBID or JOBID.NODE */
+func parseJobSpec(spec string) (id int, node string, err os.Error) {
+	idstr := spec
+	if i := strings.Index(spec, "."); i >= 0 {
+		idstr, node = spec[:i], spec[i+1:]
+	}
+	id, err = strconv.Atoi(idstr)
+	if err != nil {
+		err = os.NewError("bad job id: " + spec)
+	}
+	return
+}
+
+func parseSignal(s string) (sig int, err os.Error) {
+	if sig, err = strconv.Atoi(s); err == nil {
+		return
+	}
+	name := strings.ToUpper(s)
+	if strings.HasPrefix(name, "SIG") {
+		name = name[3:]
+	}
+	sig, ok := sigNames[name]
+	if !ok {
+		err = os.NewError("unknown signal: " + s)
+	}
+	return
+}
+
+type ucredT struct {
+	Pid, Uid, Gid int32
+}
+
+/* ucred returns the credentials of the process on the other end of a unix socket. */
+func ucred(fd int) (pid, uid, gid int, err os.Error) {
+	var cred ucredT
+	l := uint32(unsafe.Sizeof(cred))
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&l)), 0)
+	if e != 0 {
+		err = os.Errno(e)
+		return
+	}
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), nil
+}
+
+func ctlAddr(addr string) string {
+	return addr + ".ctl"
+}
+
+/* ctlserver answers ps, kill and cp on the master. One request per connection. */
+func ctlserver(addr string) (err os.Error) {
+	syscall.Unlink(ctlAddr(addr))
+	l, err := net.ListenUnix("unix", &net.UnixAddr{ctlAddr(addr), "unix"})
+	if err != nil {
+		return
+	}
+	os.Chmod(ctlAddr(addr), 0666)
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			log.Printf("ctlserver: %v\n", err)
+			continue
+		}
+		go ctl(c)
+	}
+	return
+}
+
+func ctl(c *net.UnixConn) {
+	defer c.Close()
+	var arg CtlArg
+	var res CtlRes
+	f, err := c.File()
+	if err != nil {
+		return
+	}
+	_, uid, gid, err := ucred(f.Fd())
+	f.Close()
+	if err != nil {
+		return
+	}
+	if err = gob.NewDecoder(c).Decode(&arg); err != nil {
+		return
+	}
+	switch arg.Cmd {
+	case "ps":
+		res.Msg = []byte(ps(uid, arg.Long))
+	case "kill":
+		if err = kill(uid, arg.JobId, arg.Node, arg.Sig); err != nil {
+			res.Err = err.String()
+		}
+	case "cp":
+		res.Cp = cpnodes(uid, gid, arg.Nodes, arg.Cp)
+	default:
+		res.Err = "unknown command " + arg.Cmd
+	}
+	gob.NewEncoder(c).Encode(res)
+}
+
+func jobAddr(addr string) string {
+	return addr + ".job"
+}
+
+/* jobserver takes jobs from clients, as cluster.Launcher sends them, one
+ * per connection. Each gets an exporter of its own, so that its file
+ * data and answer can't cross with another's, and the job runs as the
+ * uid and gid on the other end of the socket, not whatever the client
+ * says it is.
+ */
+func jobserver(addr string) (err os.Error) {
+	syscall.Unlink(jobAddr(addr))
+	l, err := net.ListenUnix("unix", &net.UnixAddr{jobAddr(addr), "unix"})
+	if err != nil {
+		return
+	}
+	os.Chmod(jobAddr(addr), 0666)
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			log.Printf("jobserver: %v\n", err)
+			continue
+		}
+		go startjob(c)
+	}
+	return
+}
+
+func startjob(c *net.UnixConn) {
+	f, err := c.File()
+	if err != nil {
+		c.Close()
+		return
+	}
+	_, uid, gid, err := ucred(f.Fd())
+	f.Close()
+	if err != nil {
+		log.Printf("job refused, no credentials: %v\n", err)
+		c.Close()
+		return
+	}
+	exp := netchan.NewExporter()
+	sachan := make(chan cluster.StartArg)
+	dchan := make(chan []byte)
+	res := make(chan Res)
+	for _, ch := range []struct {
+		name string
+		ch   interface{}
+		dir  netchan.Dir
+	}{
+		{"startArgChan", sachan, netchan.Recv},
+		{"filedata", dchan, netchan.Recv},
+		{"resChan", res, netchan.Send},
+	} {
+		err = exp.Export(ch.name, ch.ch, ch.dir)
+		if err != nil {
+			c.Close()
+			return
+		}
+	}
+	/* the client hangs up once it has its answer */
+	go exp.ServeConn(c)
+	sa := <-sachan
+	if closed(sachan) {
+		return
+	}
+	a := &StartArg{StartArg: sa}
+	a.Uid, a.Gid = uid, gid
+	MExec(a, dchan, res)
+}
+
+func ps(uid int, long bool) string {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	ids := make([]int, 0, len(Jobs))
+	for id, j := range Jobs {
+		if j.owned(uid) {
+			ids = append(ids, id)
+		}
+	}
+	sort.SortInts(ids)
+	s := fmt.Sprintf("%-6s %-6s %-9s %-10s %-8s %s\n", "JOBID", "UID", "STATE", "START", "NODES", "COMMAND")
+	for _, id := range ids {
+		s += Jobs[id].format(long)
+	}
+	return s
+}
+
+func kill(uid, id int, node string, sig int) (err os.Error) {
+	jobLock.Lock()
+	j, ok := Jobs[id]
+	jobLock.Unlock()
+	if !ok {
+		return os.NewError(fmt.Sprintf("no job %d", id))
+	}
+	if !j.owned(uid) {
+		return os.EPERM
+	}
+	nodes := j.Nodes
+	if node != "" {
+		if _, ok := j.Procs[node]; !ok {
+			return os.NewError(fmt.Sprintf("job %d has no node %s", id, node))
+		}
+		nodes = []string{node}
+	}
+	j.signal(nodes, sig)
+	return
+}
+
+/* ctlcall is the client side of ps, kill and cp */
+func ctlcall(server string, arg CtlArg) (res CtlRes, err os.Error) {
+	c, err := net.Dial("unix", "", ctlAddr(server))
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	err = gob.NewEncoder(c).Encode(arg)
+	if err != nil {
+		return
+	}
+	err = gob.NewDecoder(c).Decode(&res)
+	if err != nil {
+		return
+	}
+	if res.Err != "" {
+		err = os.NewError(res.Err)
+	}
+	return
+}
+
+func jobps(server string) (err os.Error) {
+	res, err := ctlcall(server, CtlArg{Cmd: "ps", Long: *longps})
+	if err != nil {
+		return
+	}
+	_, err = os.Stdout.Write(res.Msg)
+	return
+}
+
+func jobkill(server, spec string) (err os.Error) {
+	id, node, err := parseJobSpec(spec)
+	if err != nil {
+		return
+	}
+	sig, err := parseSignal(*killsig)
+	if err != nil {
+		return
+	}
+	_, err = ctlcall(server, CtlArg{Cmd: "kill", JobId: id, Node: node, Sig: sig})
+	return
+}
+
+/* the slave side: which runner is doing which job on this node, and the
+ * job's cgroup, if it got one
+ */
+type slaveProc struct {
+	pid    int
+	cgroup string
+}
+
+var (
+	procLock sync.Mutex
+	procs    = make(map[int]slaveProc)
+)
+
+/* procwait reaps the runner for a job and tells the master about it. */
+func procwait(jobid, pid int, cgroup string, echan chan ProcExit) {
+	procLock.Lock()
+	procs[jobid] = slaveProc{pid, cgroup}
+	procLock.Unlock()
+	status := -1
+	w, err := os.Wait(pid, 0)
+	if err == nil {
+		status = w.ExitStatus()
+	}
+	if DebugLevel > 1 {
+		log.Printf("job %d pid %d exits %d\n", jobid, pid, status)
+	}
+	procLock.Lock()
+	procs[jobid] = 0, false
+	procLock.Unlock()
+	e := ProcExit{JobId: jobid, Node: NodeId, Pid: pid, Status: status}
+	if cgroup != "" {
+		e.MemPeak, e.CpuUsec = cgroupUsage(cgroup)
+		removeCgroup(cgroup)
+	}
+	/* the runner cleans up after itself, unless it died first */
+	cleanStage(jobDir(jobid))
+	echan <- e
+}
+
+func slavekill(kch chan KillArg) {
+	for {
+		k := <-kch
+		procLock.Lock()
+		p, ok := procs[k.JobId]
+		procLock.Unlock()
+		if !ok {
+			continue
+		}
+		pid := p.pid
+		/* the runner itself is spared: it reports the job's status
+		 * once its processes are gone
+		 */
+		if p.cgroup != "" {
+			if err := cgroupSignal(p.cgroup, k.Sig, pid); err != nil {
+				log.Printf("kill job %d: %v\n", k.JobId, err)
+			}
+			continue
+		}
+		/* each process the runner starts leads a process group of its own */
+		for _, c := range childPids(pid) {
+			if e := syscall.Kill(-c, k.Sig); e != 0 && e != syscall.ESRCH {
+				log.Printf("kill job %d pid %d: %v\n", k.JobId, c, os.Errno(e))
+			}
+		}
+	}
+}
+
+/* childPids are the processes whose parent is pid. */
+func childPids(pid int) (pids []int) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		c, err := strconv.Atoi(d.Name)
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile("/proc/" + d.Name + "/stat")
+		if err != nil {
+			continue
+		}
+		/* pid (comm) state ppid ...; comm may have anything in it */
+		s := string(b)
+		f := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(f) > 1 && f[1] == strconv.Itoa(pid) {
+			pids = append(pids, c)
+		}
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+func TestParseSignal(t *testing.T) {
+	for name, want := range sigNames {
+		for _, s := range []string{name, "SIG" + name, strings.ToLower(name), "sig" + strings.ToLower(name)} {
+			if sig, err := parseSignal(s); err != nil || sig != want {
+				t.Errorf("%s: got %d, %v; want %d", s, sig, err, want)
+			}
+		}
+	}
+	for _, tt := range []struct {
+		s   string
+		sig int
+	}{
+		{"INT", syscall.SIGINT},
+		{"SIGSTOP", syscall.SIGSTOP},
+		{"9", 9},
+	} {
+		if sig, err := parseSignal(tt.s); err != nil || sig != tt.sig {
+			t.Errorf("%s: got %d, %v; want %d", tt.s, sig, err, tt.sig)
+		}
+	}
+	for _, s := range []string{"", "SIG", "NT", "TOP", "SIGSIGINT", "BOGUS"} {
+		if _, err := parseSignal(s); err == nil {
+			t.Errorf("%q taken as a signal", s)
+		}
+	}
+}
+
+func TestProcExitTwice(t *testing.T) {
+	j := newJob(&StartArg{StartArg: cluster.StartArg{Nodes: []string{"1"}}})
+	j.failProc("1")
+	/* the slave's report of the same node, late */
+	j.procExit(ProcExit{JobId: j.Id, Node: "1", Status: 0})
+	if j.State != "done" || j.Procs["1"].State != "failed" {
+		t.Errorf("job %s, node %s", j.State, j.Procs["1"].State)
+	}
+	if _, ok := Jobs[j.Id]; ok {
+		t.Error("job still on the books")
+	}
+}
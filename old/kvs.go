@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"gob"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"gproc-npe.googlecode.com/hg/pmi"
+)
+
+/* A key-value service for parallel programs to wire themselves up, in
+ * the manner of PMI-1. The processes talk to the runner on their node
+ * over a unix socket in /tmp/xproc. The runner keeps their puts to
+ * itself until every local process has entered the barrier, then sends
+ * them up in a single fence message. That goes to the slave over a
+ * socket it handed the runner as fd 3, and on to the master over the
+ * connection the master already keeps to the slave. When the master has
+ * heard from every node in the job it sends the whole key space back
+ * down the same way, the runners let their processes out of the barrier,
+ * and gets are answered locally from then on.
+ */
+
+const kvsSock = "pmi.sock"
+
+/* the runner's end of the socket to its slave */
+const kvsFd = 3
+
+type KvsFence struct {
+	JobId int
+	Node  string
+	Puts  map[string]string
+}
+
+type KvsData struct {
+	JobId int
+	Kvs   map[string]string
+}
+
+var (
+	kvsLock sync.Mutex
+	/* the master's: the service of each job, by id */
+	kvsJobs = make(map[int]chan KvsFence)
+	/* the slave's: the runner of each job, by id */
+	kvsRunners = make(map[int]*gob.Encoder)
+)
+
+func kvsName(jobid int) string {
+	return fmt.Sprintf("kvs_%d", jobid)
+}
+
+/* startKvs runs the master's side of the service for a job, until the job is done. */
+func startKvs(j *Job, arg *StartArg) (err os.Error) {
+	var nodes []string
+	for i, r := range arg.ranks() {
+		if len(r) > 0 {
+			nodes = append(nodes, arg.Nodes[i])
+		}
+	}
+	out := make(map[string]chan KvsData, len(nodes))
+	for _, n := range nodes {
+		s, ok := Slaves[n]
+		if !ok {
+			return os.NewError("kvs: no slave for node " + n)
+		}
+		out[n] = s.kvsd
+	}
+	fence := make(chan KvsFence)
+	kvsLock.Lock()
+	kvsJobs[j.Id] = fence
+	kvsLock.Unlock()
+	go func() {
+		defer func() {
+			kvsLock.Lock()
+			kvsJobs[j.Id] = nil, false
+			kvsLock.Unlock()
+		}()
+		kvs := make(map[string]string)
+		in := make(map[string]bool)
+		for {
+			select {
+			case f := <-fence:
+				for k, v := range f.Puts {
+					kvs[k] = v
+				}
+				in[f.Node] = true
+				if len(in) < len(nodes) {
+					continue
+				}
+				for _, c := range out {
+					c <- KvsData{JobId: j.Id, Kvs: kvs}
+				}
+				in = make(map[string]bool)
+			case <-j.done:
+				return
+			}
+		}
+	}()
+	return
+}
+
+/* kvsmaster hands the fences that come from a slave to the jobs they are for. */
+func kvsmaster(fch chan KvsFence) {
+	for {
+		f := <-fch
+		kvsLock.Lock()
+		c, ok := kvsJobs[f.JobId]
+		kvsLock.Unlock()
+		if !ok {
+			if DebugLevel > 0 {
+				log.Printf("kvs: fence from %s for job %d, which has none\n", f.Node, f.JobId)
+			}
+			continue
+		}
+		c <- f
+	}
+}
+
+/* kvsslave hands what the master sends down to the runners it is for. */
+func kvsslave(dch chan KvsData) {
+	for {
+		d := <-dch
+		kvsLock.Lock()
+		e, ok := kvsRunners[d.JobId]
+		kvsLock.Unlock()
+		if !ok {
+			continue
+		}
+		err := e.Encode(d)
+		if err != nil {
+			log.Printf("kvs: job %d: %v\n", d.JobId, err)
+		}
+	}
+}
+
+/* kvsrelay sends the fences of a job's runner up to the master, until
+ * the runner goes away.
+ */
+func kvsrelay(jobid int, f *os.File, fch chan KvsFence) {
+	defer f.Close()
+	kvsLock.Lock()
+	kvsRunners[jobid] = gob.NewEncoder(f)
+	kvsLock.Unlock()
+	defer func() {
+		kvsLock.Lock()
+		kvsRunners[jobid] = nil, false
+		kvsLock.Unlock()
+	}()
+	d := gob.NewDecoder(f)
+	for {
+		var fence KvsFence
+		err := d.Decode(&fence)
+		if err != nil {
+			return
+		}
+		fence.JobId, fence.Node = jobid, NodeId
+		fch <- fence
+	}
+}
+
+/* kvsPair makes the socket between a slave and a runner: the slave's end
+ * and the one to give the runner.
+ */
+func kvsPair() (slave, runner *os.File, err os.Error) {
+	fd, e := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if e != 0 {
+		return nil, nil, os.NewSyscallError("socketpair", e)
+	}
+	syscall.CloseOnExec(fd[0])
+	return os.NewFile(fd[0], "kvs"), os.NewFile(fd[1], "kvs"), nil
+}
+
+/* pmiServer is the runner's side of the service. */
+type pmiServer struct {
+	lock    sync.Mutex
+	arg     *StartArg
+	local   int
+	pending map[string]string
+	kvs     map[string]string
+	waiting []chan bool
+	up      *gob.Encoder
+	down    *gob.Decoder
+}
+
+/* pmiserve starts the service for the local processes of a job and
+ * returns the socket they find it on.
+ */
+func pmiserve(arg *StartArg, pathbase string, local int) (sock string, err os.Error) {
+	f := os.NewFile(kvsFd, "kvs")
+	p := &pmiServer{
+		arg:     arg,
+		local:   local,
+		pending: make(map[string]string),
+		kvs:     make(map[string]string),
+		up:      gob.NewEncoder(f),
+		down:    gob.NewDecoder(f),
+	}
+	sock = path.Join(pathbase, kvsSock)
+	syscall.Unlink(sock)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{sock, "unix"})
+	if err != nil {
+		return
+	}
+	go func() {
+		for {
+			c, err := l.AcceptUnix()
+			if err != nil {
+				log.Printf("pmi: %v\n", err)
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return
+}
+
+func (p *pmiServer) barrier() {
+	c := make(chan bool, 1)
+	p.lock.Lock()
+	p.waiting = append(p.waiting, c)
+	if len(p.waiting) < p.local {
+		p.lock.Unlock()
+		<-c
+		return
+	}
+	waiting, puts := p.waiting, p.pending
+	p.waiting, p.pending = nil, make(map[string]string)
+	p.lock.Unlock()
+
+	var d KvsData
+	err := p.up.Encode(KvsFence{Node: p.arg.NodeId, Puts: puts})
+	if err == nil {
+		err = p.down.Decode(&d)
+	}
+	if err != nil {
+		log.Printf("pmi: fence: %v\n", err)
+	}
+	p.lock.Lock()
+	for k, v := range d.Kvs {
+		p.kvs[k] = v
+	}
+	p.lock.Unlock()
+	for _, w := range waiting {
+		w <- true
+	}
+	<-c
+}
+
+func (p *pmiServer) put(key, value string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pending[key] = value
+}
+
+func (p *pmiServer) get(key string) (value string, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if value, ok = p.pending[key]; ok {
+		return
+	}
+	value, ok = p.kvs[key]
+	return
+}
+
+func (p *pmiServer) serve(c *net.UnixConn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	size := strconv.Itoa(p.arg.size())
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		m := pmi.ParseCmd(line)
+		var reply string
+		switch m["cmd"] {
+		case "init":
+			reply = pmi.FormatCmd("response_to_init", "rc", "0", "pmi_version", "1", "pmi_subversion", "1")
+		case "initack":
+			reply = pmi.FormatCmd("initack") + pmi.FormatCmd("set", "size", size) +
+				pmi.FormatCmd("set", "rank", m["pmiid"]) + pmi.FormatCmd("set", "debug", "0")
+		case "get_maxes":
+			reply = pmi.FormatCmd("maxes", "rc", "0", "kvsname_max", "256", "keylen_max", "256", "vallen_max", "1024")
+		case "get_appnum":
+			reply = pmi.FormatCmd("appnum", "rc", "0", "appnum", "0")
+		case "get_universe_size":
+			reply = pmi.FormatCmd("universe_size", "rc", "0", "size", size)
+		case "get_my_kvsname":
+			reply = pmi.FormatCmd("my_kvsname", "rc", "0", "kvsname", kvsName(p.arg.JobId))
+		case "put":
+			p.put(m["key"], m["value"])
+			reply = pmi.FormatCmd("put_result", "rc", "0", "msg", "success")
+		case "get":
+			if v, ok := p.get(m["key"]); ok {
+				reply = pmi.FormatCmd("get_result", "rc", "0", "msg", "success", "value", v)
+			} else {
+				reply = pmi.FormatCmd("get_result", "rc", "-1", "msg", "key_"+m["key"]+"_not_found")
+			}
+		case "barrier_in":
+			p.barrier()
+			reply = pmi.FormatCmd("barrier_out")
+		case "finalize":
+			c.Write([]byte(pmi.FormatCmd("finalize_ack")))
+			return
+		default:
+			reply = pmi.FormatCmd(m["cmd"], "rc", "-1", "msg", "unknown_command")
+		}
+		if _, err = c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
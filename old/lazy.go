@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"netchan"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+	"gproc-npe.googlecode.com/hg/p9"
+)
+
+/* With -lazy nothing is shipped up front. The client serves the files
+ * it would have shipped over 9P2000.L, on the channels cluster.LazyChans
+ * names. The runner mounts the tree in its namespace with the kernel's
+ * 9p client, over a socket pair to a 9P server of its own, and that
+ * server fetches each file from the client the first time it is opened
+ * and keeps it in the node's cache, /tmp/xproc/cache/<uid>, where the
+ * user's next job finds it. The uid is the one the master got from the
+ * kernel, not the client. A cached file is named by the SHA-1 of what is
+ * in it, which the client works out from its own copy (p9.HashAttr), and
+ * what is fetched has to hash to that before it goes in, so a name, size
+ * and time that match say nothing about whether a file is the one
+ * wanted. A cache is trimmed back to lazyCacheMax, oldest used first,
+ * when a job starts, and files not used for lazyCacheAge go. Names,
+ * modes and directories come straight from the client. The top-level directories of the tree are bound into the job
+ * directory, so files turn up at the same paths they would have been
+ * shipped to. The files on the -prefetch list, and the command itself,
+ * are fetched before anything starts.
+ *
+ * Mounting 9p takes CAP_SYS_ADMIN in the initial user namespace, so a
+ * rootless slave can't do it.
+ */
+
+const (
+	lazyDir      = ".lazy"
+	lazyCache    = xprocBase + "/cache"
+	lazyCacheMax = 1 << 30
+	lazyCacheAge = 7 * 24 * 3600 /* seconds */
+)
+
+/* lazyFS is the runner's view of the client's tree. */
+type lazyFS struct {
+	c     *p9.Client
+	cache string /* this user's */
+	lock  sync.Mutex
+	stat  map[string]*p9.Dir
+}
+
+func (l *lazyFS) Stat(name string) (d *p9.Dir, err os.Error) {
+	l.lock.Lock()
+	d, ok := l.stat[name]
+	l.lock.Unlock()
+	if ok {
+		return
+	}
+	d, err = l.c.Stat(name)
+	if err != nil {
+		return
+	}
+	l.lock.Lock()
+	l.stat[name] = d
+	l.lock.Unlock()
+	return
+}
+
+func (l *lazyFS) ReadDir(name string) ([]p9.Dir, os.Error) {
+	return l.c.ReadDir(name)
+}
+
+func (l *lazyFS) Readlink(name string) (string, os.Error) {
+	return l.c.Readlink(name)
+}
+
+func (l *lazyFS) Open(name string) (p9.File, os.Error) {
+	cached, err := l.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(cached, os.O_RDONLY, 0)
+}
+
+/* fetch makes sure the file is in the cache and says where. A file is
+ * known by the hash of what is in it on the client, so one that changes
+ * there is fetched again.
+ */
+func (l *lazyFS) fetch(name string) (cached string, err os.Error) {
+	sum, err := l.c.Hash(name)
+	if err != nil {
+		return
+	}
+	cached = path.Join(l.cache, fmt.Sprintf("%x", sum))
+	if _, err = os.Stat(cached); err == nil {
+		/* the time is when it was last used, for trimming */
+		now := time.Nanoseconds()
+		os.Chtimes(cached, now, now)
+		return
+	}
+	b, err := l.c.ReadFile(name)
+	if err != nil {
+		return
+	}
+	h := sha1.New()
+	h.Write(b)
+	if !bytes.Equal(h.Sum(), sum) {
+		return "", os.NewError(name + ": changed while it was fetched")
+	}
+	/* jobs on this node, and opens in this one, may fetch the same
+	 * file at once; each writes its own and the last one in wins
+	 */
+	f, err := ioutil.TempFile(l.cache, ".fetch")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(0444)
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, cached)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+/* trimCache removes what hasn't been used for lazyCacheAge, and then the
+ * least recently used until what is left fits in lazyCacheMax.
+ */
+func trimCache(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	sort.Sort(byMtime(files))
+	var total int64
+	for _, fi := range files {
+		total += fi.Size
+	}
+	old := time.Nanoseconds() - lazyCacheAge*1e9
+	for _, fi := range files {
+		if total <= lazyCacheMax && fi.Mtime_ns > old {
+			break
+		}
+		if os.Remove(path.Join(dir, fi.Name)) == nil {
+			total -= fi.Size
+		}
+	}
+}
+
+type byMtime []*os.FileInfo
+
+func (f byMtime) Len() int           { return len(f) }
+func (f byMtime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byMtime) Less(i, j int) bool { return f[i].Mtime_ns < f[j].Mtime_ns }
+
+/* mountLazy puts the client's tree under base and fetches the prefetch list. */
+func mountLazy(arg *StartArg, pathbase, base string) (err os.Error) {
+	imp, err := netchan.NewImporter(arg.Lfam, arg.Lserver)
+	if err != nil {
+		return
+	}
+	tname, rname := cluster.LazyChans(arg.NodeId)
+	conn := cluster.NewChanConn()
+	err = imp.Import(tname, conn.Out, netchan.Send)
+	if err != nil {
+		return
+	}
+	err = imp.Import(rname, conn.In, netchan.Recv)
+	if err != nil {
+		return
+	}
+	c, err := p9.NewClient(conn, "", "/")
+	if err != nil {
+		return
+	}
+	fs := &lazyFS{c: c, cache: path.Join(lazyCache, strconv.Itoa(arg.Uid)), stat: make(map[string]*p9.Dir)}
+	err = os.MkdirAll(fs.cache, 0700)
+	if err != nil {
+		return
+	}
+	trimCache(fs.cache)
+	for _, p := range arg.Prefetch {
+		if _, err := fs.fetch(p); err != nil {
+			log.Printf("prefetch %s: %v\n", p, err)
+		}
+	}
+
+	fds, e := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if e != 0 {
+		return os.Errno(e)
+	}
+	kernel := os.NewFile(fds[1], "9p")
+	defer kernel.Close()
+	go (&p9.Server{FS: fs}).Serve(os.NewFile(fds[0], "9p"))
+	mnt := path.Join(pathbase, lazyDir)
+	err = os.MkdirAll(mnt, 0755)
+	if err != nil {
+		return
+	}
+	err = mount("gproc", mnt, "9p", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV,
+		fmt.Sprintf("trans=fd,rfdno=%d,wfdno=%d,version=%s,access=any,cache=loose", fds[1], fds[1], p9.Version))
+	if err != nil {
+		return
+	}
+	top, err := fs.ReadDir("/")
+	if err != nil {
+		return
+	}
+	for _, d := range top {
+		target := path.Join(base, d.Name)
+		if d.IsLink() {
+			/* /lib -> usr/lib and the like work the same in here */
+			link, err := fs.Readlink("/" + d.Name)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if d.IsDir() {
+			err = os.MkdirAll(target, 0755)
+		} else {
+			err = ioutil.WriteFile(target, nil, 0644)
+		}
+		if err != nil {
+			return
+		}
+		err = mount(path.Join(mnt, d.Name), target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"json"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+/* Every job runs in namespaces of its own, chosen with -ns:
+ *	mount	always. The runner is cloned into a new mount namespace by
+ *		the slave, makes its mounts private so nothing leaks back out,
+ *		and mounts a tmpfs on /tmp/xproc/<jobid> that no other job
+ *		can see.
+ *	ipc	System V IPC and POSIX message queues
+ *	uts	the host name, set per node from -nshostname
+ *	pid	each launched process gets a namespace of its own, with a
+ *		gproc init as its PID 1 (see initproc); when the process
+ *		exits the init does too, and the kernel takes everything
+ *		left behind with it
+ *	net	each launched process gets an empty network namespace,
+ *		loopback only; asked for by name. The runner stays out of
+ *		it, as it needs the network to reach the client.
+ * Namespaces that the runner itself lives in are created when the slave
+ * clones it. A Go program is many threads, so unshare from inside only
+ * moves the thread that calls it.
+ */
+
+var nsFlags = map[string]int{
+	"ipc": syscall.CLONE_NEWIPC,
+	"uts": syscall.CLONE_NEWUTS,
+	"pid": syscall.CLONE_NEWPID,
+	"net": syscall.CLONE_NEWNET,
+}
+
+func nsList(ns string) (l []string) {
+	for _, n := range strings.Split(ns, ",", -1) {
+		n = strings.TrimSpace(n)
+		if n != "" && n != "mount" && n != "mnt" {
+			l = append(l, n)
+		}
+	}
+	return
+}
+
+func checkNamespaces(ns string) os.Error {
+	for _, n := range nsList(ns) {
+		if _, ok := nsFlags[n]; !ok {
+			return os.NewError("unknown namespace " + n)
+		}
+	}
+	return nil
+}
+
+func hasNamespace(ns, name string) bool {
+	for _, n := range nsList(ns) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+/* runnerCloneflags are the namespaces the slave clones the runner into. */
+func runnerCloneflags(ns string) (flags uintptr) {
+	flags = syscall.CLONE_NEWNS
+	for _, n := range nsList(ns) {
+		if n != "pid" && n != "net" {
+			flags |= uintptr(nsFlags[n])
+		}
+	}
+	return
+}
+
+/* procCloneflags are the namespaces each launched process gets on top of the runner's. */
+func procCloneflags(ns string) (flags uintptr) {
+	if hasNamespace(ns, "pid") {
+		flags |= syscall.CLONE_NEWPID
+	}
+	if hasNamespace(ns, "net") {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return
+}
+
+/* privateMount keeps the runner's mounts to itself and puts a fresh
+ * tmpfs of at most size bytes on pathbase.
+ */
+func privateMount(pathbase string, size int64) (err os.Error) {
+	if e := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); e != 0 {
+		return &os.PathError{"mount private", "/", os.Errno(e)}
+	}
+	syscall.Unmount(pathbase, syscall.MNT_DETACH)
+	if e := syscall.Mount("xproc", pathbase, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, tmpfsOptions(size)); e != 0 {
+		return &os.PathError{"mount tmpfs", pathbase, os.Errno(e)}
+	}
+	return
+}
+
+/* setNodeHostname names the node in its own UTS namespace. */
+func setNodeHostname(arg *StartArg) (err os.Error) {
+	if !hasNamespace(arg.Namespaces, "uts") || arg.Hostname == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	name := expandTemplate(arg.Hostname, arg.JobId, arg.NodeId, 0, host)
+	if e := syscall.Sethostname([]byte(name)); e != 0 {
+		return &os.PathError{"sethostname", name, os.Errno(e)}
+	}
+	return
+}
+
+/* forkproc starts a launched process in its namespaces. It goes
+ * through prepproc, which sets it up and execs it, and in a pid
+ * namespace of its own under initproc as well.
+ */
+func forkproc(arg *StartArg, execpath string, args, env []string, dir string, f []*os.File) (pid int, err os.Error) {
+	args = append(prepArgs(arg, execpath, dir), args...)
+	if hasNamespace(arg.Namespaces, "pid") {
+		args = append([]string{"gproc", "I"}, args...)
+	}
+	p, err := os.StartProcess("/proc/self/exe", args, &os.ProcAttr{
+		Env:   env,
+		Files: f,
+		Sys:   &syscall.SysProcAttr{Cloneflags: procCloneflags(arg.Namespaces), Setpgid: true},
+	})
+	if err != nil {
+		return
+	}
+	return p.Pid, nil
+}
+
+/* prepArgs start the command line of prepproc for execpath. */
+func prepArgs(arg *StartArg, execpath, dir string) []string {
+	s, _ := json.Marshal(&jobSched{
+		Rlimits:  arg.Rlimits,
+		Nice:     arg.Nice,
+		IoClass:  arg.IoClass,
+		IoLevel:  arg.IoLevel,
+		Policy:   arg.Policy,
+		Priority: arg.Priority,
+		/* a rootless slave's jobs are its user's already */
+		SetIds: !*rootless,
+		Uid:    arg.Uid,
+		Gid:    arg.Gid,
+	})
+	return []string{"gproc", "P", arg.newroot, dir, string(s), execpath}
+}
+
+/* prepproc is the last step before a launched process, run as
+ *	gproc P <root> <dir> <settings> <command> <args>...
+ * It puts the job's limits and scheduling (see sched.go) on itself,
+ * chroots to root if that is set, changes to dir, becomes the user the
+ * job is for and execs the command, which keeps them all; the runner
+ * never has them. The ids, like the scheduling, are the locked thread's
+ * alone until the exec, which makes them the process's.
+ */
+func prepproc(a []string) int {
+	if len(a) < 5 {
+		log.Printf("Usage: %s P <root> <dir> <settings> <command> <args>...\n", os.Args[0])
+		return 1
+	}
+	var s jobSched
+	err := json.Unmarshal([]byte(a[2]), &s)
+	if err != nil {
+		log.Printf("prep: %v\n", err)
+		return 126
+	}
+	/* nice, ioprio and the policy belong to the thread that execs */
+	runtime.LockOSThread()
+	err = setSched(&s)
+	if err != nil {
+		log.Printf("prep: %v\n", err)
+		return 126
+	}
+	if a[0] != "" {
+		if e := syscall.Chroot(a[0]); e != 0 {
+			log.Printf("prep: chroot %s: %v\n", a[0], os.Errno(e))
+			return 126
+		}
+	}
+	if a[1] != "" {
+		if e := syscall.Chdir(a[1]); e != 0 {
+			log.Printf("prep: chdir %s: %v\n", a[1], os.Errno(e))
+			return 126
+		}
+	}
+	if s.SetIds {
+		err = setIds(s.Uid, s.Gid)
+		if err != nil {
+			log.Printf("prep: %v\n", err)
+			return 126
+		}
+	}
+	e := syscall.Exec(a[3], a[4:], os.Environ())
+	log.Printf("prep: exec %s: %v\n", a[3], os.Errno(e))
+	return 127
+}
+
+/* setIds drops root for uid and gid, with no supplementary groups:
+ * none of root's come along.
+ */
+func setIds(uid, gid int) os.Error {
+	if e := syscall.Setgroups([]int{}); e != 0 {
+		return os.NewSyscallError("setgroups", e)
+	}
+	if e := syscall.Setgid(gid); e != 0 {
+		return os.NewSyscallError("setgid", e)
+	}
+	if e := syscall.Setuid(uid); e != 0 {
+		return os.NewSyscallError("setuid", e)
+	}
+	return nil
+}
+
+/* initproc is PID 1 of a launched process's pid namespace, run as
+ *	gproc I <command> <args>...
+ * The kernel gives the init of a namespace no default action for signals
+ * from outside it, so without this the runner's TERM, and gproc kill,
+ * would never reach the job. It starts the command in a process group of
+ * its own, passes on every signal it catches to that group, reaps
+ * whatever is orphaned to it, and exits as the command does: with its
+ * status, or 128 plus the signal that killed it.
+ */
+func initproc(a []string) int {
+	if len(a) < 2 {
+		log.Printf("Usage: %s I <command> <args>...\n", os.Args[0])
+		return 1
+	}
+	p, err := os.StartProcess("/proc/self/exe", a, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Setpgid: true},
+	})
+	if err != nil {
+		log.Printf("init: %v\n", err)
+		return 127
+	}
+	/* the job's ends of its pipes are the command's alone */
+	os.Stdin.Close()
+	os.Stdout.Close()
+	os.Stderr.Close()
+	go func() {
+		for sig := range signal.Incoming {
+			s, ok := sig.(os.UnixSignal)
+			if !ok || int(s) == syscall.SIGCHLD {
+				continue
+			}
+			syscall.Kill(-p.Pid, int(s))
+		}
+	}()
+	for {
+		w, err := os.Wait(-1, 0)
+		if err != nil {
+			log.Printf("init: %v\n", err)
+			return 1
+		}
+		if w.Pid != p.Pid {
+			continue
+		}
+		if w.Signaled() {
+			return 128 + w.Signal()
+		}
+		return w.ExitStatus()
+	}
+	panic("unreached")
+}
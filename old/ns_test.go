@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* forkproc starts the init and prepproc as /proc/self/exe, which here
+ * is the test binary; it has to answer to "I" and "P" the way gproc's
+ * main does.
+ */
+func init() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "I":
+			os.Exit(initproc(os.Args[2:]))
+		case "P":
+			os.Exit(prepproc(os.Args[2:]))
+		}
+	}
+}
+
+/* These make namespaces, so they want root: run them in the CI
+ * container, as root, with gotest.
+ */
+func asRoot(t *testing.T) bool {
+	if os.Getuid() != 0 {
+		t.Log("not root; skipped")
+		return false
+	}
+	return true
+}
+
+func startsh(t *testing.T, arg *StartArg, script string) int {
+	null, err := os.Open("/dev/null", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	pid, err := forkproc(arg, "/bin/sh", []string{"sh", "-c", script}, os.Environ(), "/", []*os.File{null, null, null})
+	if err != nil {
+		t.Fatalf("forkproc: %v", err)
+	}
+	return pid
+}
+
+/* wait gives the exit status of pid, or fails if it takes over 5s. */
+func wait(t *testing.T, pid int) int {
+	c := make(chan int, 1)
+	go func() {
+		w, err := os.Wait(pid, 0)
+		if err != nil {
+			t.Errorf("wait: %v", err)
+			c <- -1
+			return
+		}
+		c <- w.ExitStatus()
+	}()
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(5e9):
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	t.Fatalf("%d still running", pid)
+	return -1
+}
+
+func TestInitStatus(t *testing.T) {
+	if !asRoot(t) {
+		return
+	}
+	if s := wait(t, startsh(t, &StartArg{StartArg: cluster.StartArg{Namespaces: "pid"}}, "exit 7")); s != 7 {
+		t.Errorf("exit status %d, want 7", s)
+	}
+}
+
+func TestInitForwardsTerm(t *testing.T) {
+	if !asRoot(t) {
+		return
+	}
+	pid := startsh(t, &StartArg{StartArg: cluster.StartArg{Namespaces: "pid"}}, "exec sleep 100")
+	time.Sleep(200e6)
+	syscall.Kill(pid, syscall.SIGTERM)
+	if s := wait(t, pid); s != 128+syscall.SIGTERM {
+		t.Errorf("exit status %d, want %d", s, 128+syscall.SIGTERM)
+	}
+}
+
+/* zombies lists the children of pid that are dead and not reaped. */
+func zombies(pid int) (z []string) {
+	dirs, _ := ioutil.ReadDir("/proc")
+	for _, d := range dirs {
+		b, err := ioutil.ReadFile("/proc/" + d.Name + "/stat")
+		if err != nil {
+			continue
+		}
+		/* pid (comm) state ppid ... */
+		s := string(b)
+		f := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(f) > 1 && f[0] == "Z" && f[1] == fmt.Sprint(pid) {
+			z = append(z, d.Name)
+		}
+	}
+	return
+}
+
+func TestInitReaps(t *testing.T) {
+	if !asRoot(t) {
+		return
+	}
+	/* the subshell leaves its sleep to the init */
+	pid := startsh(t, &StartArg{StartArg: cluster.StartArg{Namespaces: "pid"}}, "(sleep 0.1 &); exec sleep 100")
+	time.Sleep(500e6)
+	if z := zombies(pid); len(z) > 0 {
+		t.Errorf("init left zombies %v", z)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	wait(t, pid)
+}
+
+func TestPrepLimits(t *testing.T) {
+	var before syscall.Rlimit
+	syscall.Getrlimit(rlimitNames["nofile"], &before)
+	arg := &StartArg{StartArg: cluster.StartArg{Rlimits: []cluster.Rlimit{{Name: "nofile", Cur: 64, Max: 64}}, Nice: 5}}
+	pid := startsh(t, arg, "test $(ulimit -n) -eq 64 && test $(cut -d' ' -f19 /proc/self/stat) -eq 5")
+	if s := wait(t, pid); s != 0 {
+		t.Errorf("exit status %d: the limits didn't reach the process", s)
+	}
+	/* and they stay off the runner */
+	var after syscall.Rlimit
+	syscall.Getrlimit(rlimitNames["nofile"], &after)
+	if after.Cur != before.Cur || after.Max != before.Max {
+		t.Errorf("nofile went from %v to %v", before, after)
+	}
+}
+
+func TestNetNamespace(t *testing.T) {
+	if !asRoot(t) {
+		return
+	}
+	/* the runner has to reach the client */
+	if runnerCloneflags("net")&syscall.CLONE_NEWNET != 0 {
+		t.Error("the runner is cloned into the net namespace")
+	}
+	self, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Log("no /proc/self/ns; skipped")
+		return
+	}
+	script := "test \"$(readlink /proc/self/ns/net)\" != '" + self + "'" +
+		" && test $(tail -n +3 /proc/net/dev | wc -l) -eq 1 && grep -q '^ *lo:' /proc/net/dev"
+	for _, ns := range []string{"net", "net,pid"} {
+		pid := startsh(t, &StartArg{StartArg: cluster.StartArg{Namespaces: ns}}, script)
+		if s := wait(t, pid); s != 0 {
+			t.Errorf("-ns %s: exit status %d; the process is not on its own with loopback", ns, s)
+		}
+	}
+	if now, _ := os.Readlink("/proc/self/ns/net"); now != self {
+		t.Errorf("the starter moved from %s to %s", self, now)
+	}
+}
+
+func TestPrepIds(t *testing.T) {
+	if !asRoot(t) {
+		return
+	}
+	arg := &StartArg{StartArg: cluster.StartArg{Uid: 65534, Gid: 65534}}
+	pid := startsh(t, arg, "test $(id -u) -eq 65534 && test $(id -g) -eq 65534 && test \"$(id -G)\" = 65534")
+	if s := wait(t, pid); s != 0 {
+		t.Errorf("exit status %d: the process isn't only uid and gid 65534", s)
+	}
+}
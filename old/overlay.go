@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path"
+	"syscall"
+)
+
+/* Shipped files normally land under /tmp/xproc, and the command runs as
+ * /tmp/xproc/<path> with LD_LIBRARY_PATH pointing into it. Programs that
+ * go looking in /usr/share or /etc by name don't find what was shipped.
+ * With -root the files are extracted into /tmp/xproc/<jobid>/root and
+ * the processes are chrooted into a tree where they sit at the paths
+ * they had on the head node:
+ *	overlay	an overlayfs with the bundle over the node's root, and a
+ *		tmpfs upper layer so the tree is writable without touching
+ *		either. /proc, /dev, /sys, /run, /tmp and /home are bound
+ *		in from the node, so /tmp/xproc is still there too.
+ *	bind	the node's root bound to a new place, with each shipped file
+ *		bound over its namesake. Only files that exist on the node can
+ *		be replaced this way; the rest are still found through
+ *		/tmp/xproc.
+ * Either way it all happens in the job's mount namespace.
+ */
+
+const (
+	rootDir   = "root"
+	mergedDir = ".merged"
+	upperDir  = ".upper"
+	workDir   = ".work"
+)
+
+var rootBinds = []string{"/proc", "/dev", "/sys", "/run", "/tmp", "/home"}
+
+func checkRoot(root string) os.Error {
+	switch root {
+	case "", "overlay", "bind":
+		return nil
+	}
+	return os.NewError("unknown -root " + root)
+}
+
+/* filebase is where the runner extracts shipped files. */
+func filebase(arg *StartArg, pathbase string) string {
+	if arg.Root == "" {
+		return pathbase
+	}
+	return path.Join(pathbase, rootDir)
+}
+
+func mount(source, target, fstype string, flags int, data string) os.Error {
+	if e := syscall.Mount(source, target, fstype, flags, data); e != 0 {
+		return &os.PathError{"mount " + source, target, os.Errno(e)}
+	}
+	return nil
+}
+
+/* setupRoot builds the tree the processes are chrooted into and returns its path. */
+func setupRoot(arg *StartArg, pathbase string) (newroot string, err os.Error) {
+	if arg.Root == "" {
+		return
+	}
+	newroot = path.Join(pathbase, mergedDir)
+	err = os.MkdirAll(newroot, 0755)
+	if err != nil {
+		return
+	}
+	bundle := filebase(arg, pathbase)
+	switch arg.Root {
+	case "overlay":
+		upper, work := path.Join(pathbase, upperDir), path.Join(pathbase, workDir)
+		for _, d := range []string{upper, work} {
+			err = os.MkdirAll(d, 0755)
+			if err != nil {
+				return
+			}
+		}
+		/* the bundle is the user's; nothing in it may be setuid */
+		err = mount("overlay", newroot, "overlay", syscall.MS_NOSUID|syscall.MS_NODEV,
+			"lowerdir="+bundle+":/,upperdir="+upper+",workdir="+work)
+		if err != nil {
+			return
+		}
+		for _, d := range rootBinds {
+			if _, e := os.Stat(d); e != nil {
+				continue
+			}
+			err = mount(d, newroot+d, "", syscall.MS_BIND|syscall.MS_REC, "")
+			if err != nil {
+				return
+			}
+		}
+	case "bind":
+		err = mount("/", newroot, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return
+		}
+		for _, name := range arg.shipped {
+			if _, e := os.Stat(path.Join(newroot, name)); e != nil {
+				continue
+			}
+			err = mount(path.Join(bundle, name), path.Join(newroot, name), "", syscall.MS_BIND, "")
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"./ldd"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+)
+
+/* A pack file is a job's takeout worked out once and kept:
+ *	gproc pack -o app.gpk [-f extra,...] cmd [args]
+ * does what e would do to find the files, ldd and all, and writes them
+ * to app.gpk with the reason each one is there.
+ *	gproc -bundle app.gpk e <server> <fam> <address> <nodes> [cmd args]
+ * launches from it without looking at the file system, with the packed
+ * command and arguments unless others are given.
+ *	gproc unpack app.gpk DIR
+ *	gproc inspect app.gpk
+ * extract it, or list it.
+ *
+ * The file is a magic line, a manifest the way a bundle has its entries,
+ * and then the contents, stored once per distinct content by SHA-1, in
+ * the order of Manifest.Blobs. On the way to the nodes it is turned back
+ * into an ordinary bundle.
+ */
+
+const packMagic = "gproc pack 1\n"
+
+type PackEntry struct {
+	Entry  bundle.Entry
+	Hash   string /* of the contents, for regular files */
+	Reason string
+}
+
+type PackBlob struct {
+	Hash string
+	Size int64
+}
+
+type Manifest struct {
+	Args    []string
+	Created int64
+	Entries []PackEntry
+	Blobs   []PackBlob
+}
+
+type Pack struct {
+	Manifest
+	f       *os.File
+	offsets map[string]int64
+}
+
+/* packVisitor finds the files under one takeout path. */
+type packVisitor struct {
+	reason  string
+	seen    map[string]bool
+	entries []PackEntry
+}
+
+func (v *packVisitor) add(p string, f *os.FileInfo) {
+	if v.seen[p] || takeoutRules.skip(p) {
+		return
+	}
+	v.seen[p] = true
+	e, err := bundle.NewEntry(p[1:], p, f)
+	if err != nil {
+		log.Printf("pack %s: %v\n", p, err)
+		return
+	}
+	v.entries = append(v.entries, PackEntry{Entry: e, Reason: v.reason})
+}
+
+func (v *packVisitor) VisitDir(p string, f *os.FileInfo) bool {
+	if takeoutRules.skip(p) {
+		return false
+	}
+	v.add(p, f)
+	return true
+}
+
+func (v *packVisitor) VisitFile(p string, f *os.FileInfo) {
+	if f.IsRegular() || f.IsSymlink() {
+		v.add(p, f)
+	}
+}
+
+func (v *packVisitor) walk(p, reason string) {
+	p = path.Clean(p)
+	if !strings.HasPrefix(p, "/") {
+		wd, _ := os.Getwd()
+		p = path.Join(wd, p)
+	}
+	v.reason = reason
+	path.Walk(p, v, nil)
+}
+
+/* discover finds everything a job running args needs: the -f paths and,
+ * unless the command is to be found on the nodes, the command and its
+ * libraries. The takeout rules have their say.
+ */
+func discover(args, extra []string, local bool) []PackEntry {
+	v := &packVisitor{seen: make(map[string]bool)}
+	for _, s := range extra {
+		if s != "" {
+			v.walk(s, "-f "+s)
+		}
+	}
+	if local {
+		return v.entries
+	}
+	v.walk(args[0], "command")
+	e, _ := ldd.Ldd(args[0], *root, strings.Split(*libs, ":", -1))
+	for _, s := range e {
+		v.walk(s, "library of "+args[0])
+	}
+	return v.entries
+}
+
+func packEntries(p []PackEntry) []bundle.Entry {
+	entries := make([]bundle.Entry, len(p))
+	for i, e := range p {
+		entries[i] = e.Entry
+	}
+	return entries
+}
+
+func hashFile(name string) (hash string, err os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	return fmt.Sprintf("%x", h.Sum()), err
+}
+
+/* hashData hashes the entry's data as it goes in a bundle. */
+func hashData(e *bundle.Entry) (hash string, err os.Error) {
+	h := sha1.New()
+	err = bundle.CopyData(h, e.Source(), e)
+	return fmt.Sprintf("%x", h.Sum()), err
+}
+
+/* writePack puts the files a job running args needs into name. */
+func writePack(name string, args, extra []string) (err os.Error) {
+	m := Manifest{Args: args, Created: time.Seconds(), Entries: discover(args, extra, false)}
+	entries := packEntries(m.Entries)
+	bundle.Link(entries)
+	src := make(map[string]*bundle.Entry)
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		e.Entry = entries[i]
+		if !e.Entry.HasData() {
+			continue
+		}
+		e.Hash, err = hashData(&e.Entry)
+		if err != nil {
+			return
+		}
+		if _, ok := src[e.Hash]; !ok {
+			src[e.Hash] = &e.Entry
+			m.Blobs = append(m.Blobs, PackBlob{e.Hash, e.Entry.DataSize()})
+		}
+	}
+	f, err := os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(packMagic)
+	if err != nil {
+		return
+	}
+	err = bundle.WriteHeader(f, &m)
+	if err != nil {
+		return
+	}
+	for _, b := range m.Blobs {
+		e := src[b.Hash]
+		err = bundle.CopyData(f, e.Source(), e)
+		if err != nil {
+			return os.NewError(fmt.Sprintf("%s changed while packing: %v", e.Source(), err))
+		}
+	}
+	return
+}
+
+func openPack(name string) (p *Pack, err os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	magic := make([]byte, len(packMagic))
+	_, err = io.ReadFull(f, magic)
+	if err != nil || string(magic) != packMagic {
+		f.Close()
+		return nil, os.NewError(name + ": not a pack file")
+	}
+	p = &Pack{f: f, offsets: make(map[string]int64)}
+	n, err := bundle.ReadHeader(f, &p.Manifest)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	off := int64(len(packMagic)) + n
+	for _, b := range p.Blobs {
+		if b.Size < 0 {
+			p.f.Close()
+			return nil, os.NewError(name + ": bad blob size")
+		}
+		p.offsets[b.Hash] = off
+		off += b.Size
+	}
+	for _, e := range p.Entries {
+		if _, ok := p.offsets[e.Hash]; e.Entry.HasData() && !ok {
+			p.f.Close()
+			return nil, os.NewError(name + ": no data for " + e.Entry.Name)
+		}
+	}
+	return
+}
+
+func (p *Pack) Close() os.Error {
+	return p.f.Close()
+}
+
+func (p *Pack) blob(hash string, size int64) io.Reader {
+	return io.NewSectionReader(p.f, p.offsets[hash], size)
+}
+
+/* size is how much the pack holds, and how much it would be without sharing. */
+func (p *Pack) size() (stored, total int64) {
+	for _, b := range p.Blobs {
+		stored += b.Size
+	}
+	for _, e := range p.Entries {
+		total += e.Entry.Size
+	}
+	return
+}
+
+/* writeBundle writes the pack to w as a bundle, which is what the runners unpack. */
+func (p *Pack) writeBundle(w io.Writer) (err os.Error) {
+	err = bundle.WriteHeader(w, packEntries(p.Entries))
+	if err != nil {
+		return
+	}
+	for _, e := range p.Entries {
+		if e.Entry.HasData() {
+			n := e.Entry.DataSize()
+			_, err = io.Copyn(w, p.blob(e.Hash, n), n)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/* extract unpacks the pack under dir. The Extractor checks the names,
+ * since a pack file is anybody's and nothing has been through Scan.
+ */
+func (p *Pack) extract(dir string) (err os.Error) {
+	x := &bundle.Extractor{Base: dir}
+	for i := range p.Entries {
+		e := &p.Entries[i]
+		var data io.Reader
+		if e.Entry.HasData() {
+			data = p.blob(e.Hash, e.Entry.DataSize())
+		}
+		err = x.Entry(&e.Entry, data)
+		if err != nil {
+			return
+		}
+	}
+	return x.Finish()
+}
+
+func (p *Pack) inspect(w io.Writer) {
+	stored, total := p.size()
+	fmt.Fprintf(w, "command: %s\n", strings.Join(p.Args, " "))
+	fmt.Fprintf(w, "packed:  %s\n", time.SecondsToLocalTime(p.Created).String())
+	fmt.Fprintf(w, "files:   %d, %d distinct contents\n", len(p.Entries), len(p.Blobs))
+	fmt.Fprintf(w, "size:    %d bytes stored, %d unpacked\n", stored, total)
+	entries := make([]string, len(p.Entries))
+	lines := make(map[string]string)
+	for i, e := range p.Entries {
+		hash := e.Hash
+		switch {
+		case hash == "":
+			hash = "-"
+		case len(hash) > 12:
+			hash = hash[:12]
+		}
+		entries[i] = e.Entry.Name
+		lines[e.Entry.Name] = fmt.Sprintf("%07o %10d %-12s /%s\t%s\n", e.Entry.Mode, e.Entry.Size, hash, e.Entry.Name, e.Reason)
+	}
+	sort.SortStrings(entries)
+	for _, n := range entries {
+		fmt.Fprint(w, lines[n])
+	}
+}
+
+/* pack, unpack and inspect take their own arguments after the command name. */
+func packcmd(a []string) (err os.Error) {
+	out := ""
+	var extra []string
+	if *takeout != "" {
+		extra = strings.Split(*takeout, ",", -1)
+	}
+	for len(a) > 0 && strings.HasPrefix(a[0], "-") {
+		if len(a) < 2 {
+			break
+		}
+		switch a[0] {
+		case "-o":
+			out = a[1]
+		case "-f":
+			extra = append(extra, strings.Split(a[1], ",", -1)...)
+		default:
+			return os.NewError("pack: unknown option " + a[0])
+		}
+		a = a[2:]
+	}
+	if out == "" || len(a) == 0 {
+		return os.NewError("Usage: gproc pack -o FILE [-f extra,...] cmd [args]")
+	}
+	return writePack(out, a, extra)
+}
+
+func unpackcmd(file, dir string) (err os.Error) {
+	p, err := openPack(file)
+	if err != nil {
+		return
+	}
+	defer p.Close()
+	return p.extract(dir)
+}
+
+func inspectcmd(file string) (err os.Error) {
+	p, err := openPack(file)
+	if err != nil {
+		return
+	}
+	defer p.Close()
+	p.inspect(os.Stdout)
+	return
+}
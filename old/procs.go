@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"netchan"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* A job can put more than one process on a node: -ppn says how many per
+ * node, -np how many in all, and -dist whether ranks fill one node
+ * before going on to the next (block) or are dealt out a node at a time
+ * (cyclic). Where each rank lives comes from cluster.RankMap, which
+ * everyone computes from the StartArg, so it never has to travel.
+ *
+ * Each runner extracts the files once and forks its processes from
+ * them. With -bind each process is held to one core, or to one socket,
+ * of the node it runs on, going by the topology in sysfs.
+ */
+
+func (arg *StartArg) ranks() [][]int {
+	return cluster.RankMap(arg.Nodes, arg.Np, arg.Ppn, arg.Dist)
+}
+
+func (arg *StartArg) size() int {
+	return cluster.JobSize(arg.Nodes, arg.Np, arg.Ppn, arg.Dist)
+}
+
+/* shared says whether any node runs more than one process of the job. */
+func (arg *StartArg) shared() bool {
+	for _, r := range arg.ranks() {
+		if len(r) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+type topology struct {
+	cores   [][]int /* the cpus of each core */
+	sockets [][]int /* the cpus of each socket */
+}
+
+const sysCpu = "/sys/devices/system/cpu"
+
+func readInt(name string) (int, os.Error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+/* readTopology finds out which cpus share a core and which share a socket. */
+func readTopology() (t *topology, err os.Error) {
+	d, err := os.Open(sysCpu, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+	var cpus []int
+	for _, n := range names {
+		if !strings.HasPrefix(n, "cpu") {
+			continue
+		}
+		c, err := strconv.Atoi(n[3:])
+		if err != nil {
+			continue
+		}
+		cpus = append(cpus, c)
+	}
+	sort.SortInts(cpus)
+	t = &topology{}
+	coreIdx := make(map[string]int)
+	sockIdx := make(map[int]int)
+	for _, c := range cpus {
+		dir := fmt.Sprintf("%s/cpu%d/topology/", sysCpu, c)
+		sock, err := readInt(dir + "physical_package_id")
+		if err != nil {
+			continue
+		}
+		core, err := readInt(dir + "core_id")
+		if err != nil {
+			continue
+		}
+		i, ok := sockIdx[sock]
+		if !ok {
+			i = len(t.sockets)
+			sockIdx[sock] = i
+			t.sockets = append(t.sockets, nil)
+		}
+		t.sockets[i] = append(t.sockets[i], c)
+		key := fmt.Sprintf("%d/%d", sock, core)
+		i, ok = coreIdx[key]
+		if !ok {
+			i = len(t.cores)
+			coreIdx[key] = i
+			t.cores = append(t.cores, nil)
+		}
+		t.cores[i] = append(t.cores[i], c)
+	}
+	if len(t.cores) == 0 {
+		err = os.NewError("no cpu topology in " + sysCpu)
+	}
+	return
+}
+
+type cpuset [16]uint64
+
+func (s *cpuset) set(cpus []int) {
+	for _, c := range cpus {
+		if c < len(s)*64 {
+			s[c/64] |= 1 << uint(c%64)
+		}
+	}
+}
+
+/* getaffinity and setaffinity work on the calling thread only. */
+func getaffinity() (s cpuset, err os.Error) {
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, uintptr(unsafe.Sizeof(s)), uintptr(unsafe.Pointer(&s)))
+	if e != 0 {
+		err = os.Errno(e)
+	}
+	return
+}
+
+func setaffinity(s *cpuset) (err os.Error) {
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(unsafe.Sizeof(*s)), uintptr(unsafe.Pointer(s)))
+	if e != 0 {
+		err = os.Errno(e)
+	}
+	return
+}
+
+/* bindset is the set of cpus the local rank gets, if it is bound at all. */
+func bindset(t *topology, bind string, localRank, localSize int) (s cpuset, ok bool) {
+	if t == nil {
+		return
+	}
+	switch bind {
+	case "core":
+		s.set(t.cores[localRank%len(t.cores)])
+	case "socket":
+		s.set(t.sockets[localRank*len(t.sockets)/localSize])
+	default:
+		return
+	}
+	return s, true
+}
+
+/* forkbound forks a process that starts out bound to the cpus in s. The
+ * affinity is set on our own thread just for the fork, which the child
+ * inherits, so it is in place before the child runs a single instruction.
+ * run() has already locked us to the thread.
+ */
+func forkbound(s *cpuset, arg *StartArg, execpath string, args, env []string, dir string, f []*os.File) (pid int, err os.Error) {
+	old, err := getaffinity()
+	if err != nil {
+		return
+	}
+	err = setaffinity(s)
+	if err != nil {
+		return
+	}
+	pid, err = forkproc(arg, execpath, args, env, dir, f)
+	setaffinity(&old)
+	return
+}
+
+/* startproc starts the process of one rank on this node and the relays
+ * for its output.
+ */
+func startproc(arg *StartArg, imp *netchan.Importer, wchan chan cluster.IoData, t *topology, rank, localRank, localSize int, execpath, pathbase string, wg *sync.WaitGroup) (pid int, err os.Error) {
+	in, err := stdinimport(imp, arg, rank)
+	if err != nil {
+		return
+	}
+	ow, ew, err := noderedirect(arg, pathbase, rank)
+	if err != nil {
+		in.Close()
+		return
+	}
+	var or, er *os.File
+	if ow == nil {
+		or, ow, err = os.Pipe()
+		if err != nil {
+			return
+		}
+	}
+	if ew == nil {
+		er, ew, err = os.Pipe()
+		if err != nil {
+			return
+		}
+	}
+	f := []*os.File{in, ow, ew}
+	env := procEnv(arg, rank, arg.size(), localRank, localSize)
+	if s, ok := bindset(t, arg.Bind, localRank, localSize); ok {
+		pid, err = forkbound(&s, arg, execpath, arg.Args, env, pathbase, f)
+	} else {
+		pid, err = forkproc(arg, execpath, arg.Args, env, pathbase, f)
+	}
+	in.Close()
+	ow.Close()
+	ew.Close()
+	if err != nil {
+		if or != nil {
+			or.Close()
+		}
+		if er != nil {
+			er.Close()
+		}
+		return
+	}
+	host, _ := os.Hostname()
+	d := cluster.IoData{JobId: arg.JobId, Node: arg.NodeId, Rank: rank, Src: arg.NodeId, Host: host}
+	if arg.shared() {
+		d.Src = fmt.Sprintf("%s.%d", arg.NodeId, rank)
+	}
+	if or != nil {
+		wg.Add(1)
+		d.Fd = 1
+		go relay(d, arg.RawIO, or, wchan, wg)
+	}
+	if er != nil {
+		wg.Add(1)
+		d.Fd = 2
+		go relay(d, arg.RawIO, er, wchan, wg)
+	}
+	return
+}
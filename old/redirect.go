@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* For batch runs each node's stdout and stderr can go to files named by
+ * a template instead of the terminal:
+ *	%j	job ID
+ *	%n	node ID
+ *	%r	rank of the process
+ *	%h	the node's hostname
+ *	%%	a %
+ * By default the client does it as the output comes in. With -noderedirect
+ * the runner on each node writes the files itself, under the stage-out
+ * directory in /tmp/xproc, and they come back with the rest of the
+ * stage-out files.
+ */
+
+const stageoutDir = "stageout"
+
+func expandTemplate(t string, jobid int, node string, rank int, host string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(t); i++ {
+		if t[i] != '%' || i+1 == len(t) {
+			b.WriteByte(t[i])
+			continue
+		}
+		i++
+		switch t[i] {
+		case 'j':
+			b.WriteString(strconv.Itoa(jobid))
+		case 'n':
+			b.WriteString(node)
+		case 'r':
+			b.WriteString(strconv.Itoa(rank))
+		case 'h':
+			b.WriteString(host)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(t[i])
+		}
+	}
+	return b.String()
+}
+
+func rankOf(nodes []string, node string) int {
+	for i, n := range nodes {
+		if n == node {
+			return i
+		}
+	}
+	return -1
+}
+
+func createPath(name string) (f *os.File, err os.Error) {
+	dir, _ := path.Split(name)
+	if dir != "" {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return
+		}
+	}
+	return os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0644)
+}
+
+/* redirector is the client side outputter. Files are opened the first
+ * time a node has something to say, so a node that stays quiet leaves
+ * no empty file behind. Processes whose names expand to the same path,
+ * e.g. the ranks on one node with a template without %r, share one
+ * file rather than truncating it in turn.
+ */
+type redirector struct {
+	lock      sync.Mutex
+	templates [3]string
+	files     [3]map[string]*os.File
+	byName    map[string]*os.File
+	pass      outputter
+}
+
+func newRedirector(stdout, stderr string, pass outputter) *redirector {
+	r := &redirector{pass: pass}
+	r.templates[1] = stdout
+	r.templates[2] = stderr
+	for i := range r.files {
+		r.files[i] = make(map[string]*os.File)
+	}
+	r.byName = make(map[string]*os.File)
+	return r
+}
+
+func (r *redirector) write(d cluster.IoData) {
+	if r.templates[d.Fd] == "" {
+		r.pass.write(d)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f, ok := r.files[d.Fd][d.Src]
+	if !ok {
+		name := expandTemplate(r.templates[d.Fd], d.JobId, d.Node, d.Rank, d.Host)
+		f, ok = r.byName[name]
+		if !ok {
+			var err os.Error
+			f, err = createPath(name)
+			if err != nil {
+				log.Printf("%s: %v\n", name, err)
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			}
+			r.byName[name] = f
+		}
+		r.files[d.Fd][d.Src] = f
+	}
+	if f == nil {
+		return
+	}
+	f.Write(d.Data)
+}
+
+func (r *redirector) flush() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, f := range r.byName {
+		if f != nil {
+			f.Close()
+		}
+	}
+	for i := range r.files {
+		r.files[i] = make(map[string]*os.File)
+	}
+	r.byName = make(map[string]*os.File)
+	r.pass.flush()
+}
+
+/* noderedirect opens the files for the runner when the node does the
+ * redirection. A nil file means that descriptor is relayed as usual.
+ */
+func noderedirect(arg *StartArg, pathbase string, rank int) (out, errf *os.File, err os.Error) {
+	if !arg.NodeRedirect {
+		return
+	}
+	host, _ := os.Hostname()
+	dir := path.Join(pathbase, stageoutDir)
+	if arg.Stdout != "" {
+		out, err = createUnder(dir, expandTemplate(arg.Stdout, arg.JobId, arg.NodeId, rank, host))
+		if err != nil {
+			return
+		}
+	}
+	if arg.Stderr != "" {
+		errf, err = createUnder(dir, expandTemplate(arg.Stderr, arg.JobId, arg.NodeId, rank, host))
+		if err != nil {
+			if out != nil {
+				out.Close()
+			}
+			return
+		}
+	}
+	return
+}
+
+/* createUnder creates name in dir. The name comes from the user's
+ * template and the runner is root, so it has to stay in dir: no
+ * absolute paths and no .. in it.
+ */
+func createUnder(dir, name string) (*os.File, os.Error) {
+	if path.IsAbs(name) {
+		return nil, os.NewError("redirect " + name + ": absolute path")
+	}
+	for _, s := range strings.Split(name, "/", -1) {
+		if s == ".." {
+			return nil, os.NewError("redirect " + name + ": .. in path")
+		}
+	}
+	return createPath(path.Join(dir, name))
+}
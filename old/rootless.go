@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* A slave started with -rootless runs as an ordinary user. It clones
+ * each runner into a user namespace as well as the others, where the
+ * runner is root as far as its own namespaces go: it can mount the
+ * tmpfs on /tmp/xproc, set the host name and make PID namespaces, but
+ * none of it reaches past the job. -idmap picks how ids are mapped:
+ *	single	the slave's uid and gid become 0 inside; nothing else is
+ *		mapped, so files belonging to anyone else show up as nobody
+ *	subid	0 is the slave's uid as above, and 1 on up come from the
+ *		slave user's ranges in /etc/subuid and /etc/subgid, set up
+ *		with newuidmap and newgidmap
+ *
+ * What each feature needs from the slave:
+ *	private /tmp/xproc (-p)	CAP_SYS_ADMIN, or rootless
+ *	-ns ipc,uts,pid,net	CAP_SYS_ADMIN, or rootless
+ *	-bind			nothing
+ *	-root bind		CAP_SYS_ADMIN, or rootless
+ *	-root overlay		CAP_SYS_ADMIN, or rootless on Linux 5.11 and later
+ *	-cgroup and limits	a cgroup v2 directory delegated to the slave's
+ *				  user; without one, jobs that ask for limits
+ *				  are refused
+ *	-lazy			CAP_SYS_ADMIN; 9p can't be mounted in a user
+ *				  namespace
+ *	-t			nothing
+ *	kill, ps		nothing; a rootless slave only signals its own jobs
+ *	running the job as the	root, which prepproc gives up for the uid
+ *	  requesting user	  and gid the master took from the client's
+ *				  socket; a rootless slave runs every job as
+ *				  itself and refuses jobs from other users
+ * Anything that can't be done is refused by the slave before it starts
+ * a runner, with a reason that comes back in the job's Res.
+ */
+
+/* rootlessOK checks at startup that the kernel and system will let us
+ * do what -rootless needs.
+ */
+func rootlessOK() (err os.Error) {
+	if b, e := ioutil.ReadFile("/proc/sys/user/max_user_namespaces"); e == nil {
+		if strings.TrimSpace(string(b)) == "0" {
+			return os.NewError("rootless: user namespaces are disabled (user.max_user_namespaces is 0)")
+		}
+	}
+	if b, e := ioutil.ReadFile("/proc/sys/kernel/unprivileged_userns_clone"); e == nil {
+		if strings.TrimSpace(string(b)) == "0" {
+			return os.NewError("rootless: unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone is 0)")
+		}
+	}
+	switch *idmap {
+	case "single":
+	case "subid":
+		for _, m := range []string{"newuidmap", "newgidmap"} {
+			if _, err = findPath(m); err != nil {
+				return
+			}
+		}
+		for _, f := range []string{"/etc/subuid", "/etc/subgid"} {
+			if _, _, err = subidRange(f); err != nil {
+				return
+			}
+		}
+	default:
+		return os.NewError("unknown -idmap " + *idmap)
+	}
+	return
+}
+
+/* rootlessCheck refuses jobs a rootless slave can't run properly. */
+func rootlessCheck(arg *StartArg) os.Error {
+	if !*rootless {
+		return nil
+	}
+	if arg.Uid != os.Getuid() {
+		return os.NewError(fmt.Sprintf("rootless slave runs as uid %d and won't run jobs for uid %d", os.Getuid(), arg.Uid))
+	}
+	if arg.Lazy {
+		return os.NewError("rootless slave can't mount the -lazy file tree")
+	}
+	return nil
+}
+
+/* runnerSysProcAttr is how the slave clones a runner. */
+func runnerSysProcAttr(arg *StartArg) *syscall.SysProcAttr {
+	s := &syscall.SysProcAttr{Cloneflags: runnerCloneflags(arg.Namespaces)}
+	if !*rootless {
+		return s
+	}
+	s.Cloneflags |= syscall.CLONE_NEWUSER
+	if *idmap == "single" {
+		s.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		s.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		s.GidMappingsEnableSetgroups = false
+	}
+	return s
+}
+
+/* idmapAfter says whether a runner's maps are written after it is
+ * started, by idmapRunner, rather than by the clone.
+ */
+func idmapAfter() bool {
+	return *rootless && *idmap == "subid"
+}
+
+/* idmapRunner sets up the subid maps for a runner, which is held in
+ * idmapWait until they are.
+ */
+func idmapRunner(pid int) (err os.Error) {
+	if !idmapAfter() {
+		return
+	}
+	for _, m := range []struct {
+		cmd, file string
+		id        int
+	}{
+		{"newuidmap", "/etc/subuid", os.Getuid()},
+		{"newgidmap", "/etc/subgid", os.Getgid()},
+	} {
+		start, count, err := subidRange(m.file)
+		if err != nil {
+			return err
+		}
+		err = run1(m.cmd, strconv.Itoa(pid), "0", strconv.Itoa(m.id), "1",
+			"1", strconv.Itoa(start), strconv.Itoa(count))
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+/* idmapWait is where a runner started as "R idmap" begins. It was
+ * exec'd before it had any maps, as an unmapped uid, and exec took
+ * away its capabilities for that. Once the slave has run newuidmap and
+ * newgidmap it closes the other end of fd 4; the runner then execs
+ * itself again, now as root in its namespace, which gives them back.
+ * Nothing has been read from stdin yet, so the StartArg is still there.
+ */
+func idmapWait() {
+	f := os.NewFile(4, "idmap")
+	b := make([]byte, 1)
+	f.Read(b)
+	f.Close()
+	args := os.Args[:len(os.Args)-1]
+	e := syscall.Exec("/proc/self/exe", args, os.Environ())
+	log.Exitf("idmap: exec: %v\n", os.Errno(e))
+}
+
+/* subidRange finds our range in /etc/subuid or /etc/subgid, by name or by id. */
+func subidRange(file string) (start, count int, err os.Error) {
+	f, err := os.Open(file, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	id := os.Getuid()
+	if strings.HasSuffix(file, "gid") {
+		id = os.Getgid()
+	}
+	names := []string{os.Getenv("USER"), os.Getenv("LOGNAME"), strconv.Itoa(id)}
+	r := bufio.NewReader(f)
+	for {
+		line, e := r.ReadString('\n')
+		fields := strings.Split(strings.TrimSpace(line), ":", -1)
+		if len(fields) == 3 {
+			for _, n := range names {
+				if n != "" && n == fields[0] {
+					start, err = strconv.Atoi(fields[1])
+					if err != nil {
+						return
+					}
+					count, err = strconv.Atoi(fields[2])
+					return
+				}
+			}
+		}
+		if e != nil {
+			break
+		}
+	}
+	return 0, 0, os.NewError("no entry for this user in " + file)
+}
+
+func findPath(cmd string) (string, os.Error) {
+	for _, dir := range strings.Split(os.Getenv("PATH")+":/usr/bin:/bin", ":", -1) {
+		p := dir + "/" + cmd
+		if fi, err := os.Stat(p); err == nil && fi.IsRegular() && fi.Mode&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", os.NewError(cmd + " not found")
+}
+
+/* run1 runs a command to completion and fails if it does. */
+func run1(cmd string, args ...string) (err os.Error) {
+	p, err := findPath(cmd)
+	if err != nil {
+		return
+	}
+	proc, err := os.StartProcess(p, append([]string{cmd}, args...), &os.ProcAttr{
+		Files: []*os.File{nil, os.Stderr, os.Stderr},
+	})
+	if err != nil {
+		return
+	}
+	w, err := proc.Wait(0)
+	if err != nil {
+		return
+	}
+	if w.ExitStatus() != 0 {
+		err = os.NewError(fmt.Sprintf("%s %s: exit status %d", cmd, strings.Join(args, " "), w.ExitStatus()))
+	}
+	return
+}
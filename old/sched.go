@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* Resource limits, niceness, I/O priority and scheduling policy for the
+ * processes of a job. The client asks for them with -rlimit, -nice,
+ * -ioprio and -sched; the master holds them to the site's caps from
+ * gpconfig before anything is launched. The runner never takes them on
+ * itself, where a small limit or a realtime policy would get in the way
+ * of its own work: each process is started through gproc P (prepproc),
+ * which puts them on itself and then execs the process.
+ *
+ * A gpconfig with caps looks like
+ *	"Caps": {
+ *		"Rlimits": {"stack": 1073741824, "core": 0},
+ *		"MinNice": 0,
+ *		"Realtime": false
+ *	}
+ * A limit that isn't listed is left to what the slave itself may set.
+ */
+
+/* jobSched is what prepproc puts on a process, and who it runs as:
+ * with SetIds, Uid and Gid and no other groups.
+ */
+type jobSched struct {
+	Rlimits  []cluster.Rlimit
+	Nice     int
+	IoClass  int
+	IoLevel  int
+	Policy   int
+	Priority int
+	SetIds   bool
+	Uid, Gid int
+}
+
+type SiteCaps struct {
+	Rlimits  map[string]uint64
+	MinNice  int
+	Realtime bool /* may jobs use fifo, rr and the rt I/O class */
+}
+
+const rlimInfinity = ^uint64(0)
+
+/* linux numbering; syscall does not have all of them */
+var rlimitNames = map[string]int{
+	"cpu":     0,
+	"fsize":   1,
+	"data":    2,
+	"stack":   3,
+	"core":    4,
+	"nproc":   6,
+	"nofile":  7,
+	"memlock": 8,
+	"as":      9,
+}
+
+var schedPolicies = map[string]int{
+	"other": 0,
+	"fifo":  1,
+	"rr":    2,
+	"batch": 3,
+	"idle":  5,
+}
+
+var ioClasses = map[string]int{
+	"rt":   1,
+	"be":   2,
+	"idle": 3,
+}
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+/* rlimitList is a flag that can be given more than once: NAME=CUR[:MAX] */
+type rlimitList []cluster.Rlimit
+
+func (l *rlimitList) String() string {
+	s := make([]string, len(*l))
+	for i, r := range *l {
+		s[i] = fmt.Sprintf("%s=%s:%s", r.Name, rlimString(r.Cur), rlimString(r.Max))
+	}
+	return strings.Join(s, " ")
+}
+
+func (l *rlimitList) Set(s string) bool {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return false
+	}
+	r := cluster.Rlimit{Name: strings.ToLower(s[:i])}
+	if _, ok := rlimitNames[r.Name]; !ok {
+		return false
+	}
+	v := strings.Split(s[i+1:], ":", 2)
+	var err os.Error
+	r.Cur, err = parseRlim(v[0])
+	if err != nil {
+		return false
+	}
+	r.Max = r.Cur
+	if len(v) == 2 {
+		r.Max, err = parseRlim(v[1])
+		if err != nil || r.Cur > r.Max {
+			return false
+		}
+	}
+	*l = append(*l, r)
+	return true
+}
+
+var rlimitSettings rlimitList
+
+func parseRlim(s string) (uint64, os.Error) {
+	if s == "unlimited" || s == "infinity" {
+		return rlimInfinity, nil
+	}
+	n, err := parseSize(s)
+	if err != nil || n < 0 {
+		return 0, os.NewError("bad limit " + s)
+	}
+	return uint64(n), nil
+}
+
+func rlimString(v uint64) string {
+	if v == rlimInfinity {
+		return "unlimited"
+	}
+	return strconv.Uitoa64(v)
+}
+
+/* parseClass reads NAME[:LEVEL] for -ioprio and -sched. */
+func parseClass(s string, names map[string]int) (class, level int, err os.Error) {
+	v := strings.Split(s, ":", 2)
+	class, ok := names[v[0]]
+	if !ok {
+		return 0, 0, os.NewError("unknown class " + v[0])
+	}
+	if len(v) == 2 {
+		level, err = strconv.Atoi(v[1])
+	}
+	return
+}
+
+/* checkSched makes sure the settings make sense, on the client. */
+func checkSched(arg *cluster.JobSpec) os.Error {
+	if arg.Nice < -20 || arg.Nice > 19 {
+		return os.NewError("-nice must be between -20 and 19")
+	}
+	if arg.IoClass != 0 && (arg.IoLevel < 0 || arg.IoLevel > 7) {
+		return os.NewError("-ioprio level must be between 0 and 7")
+	}
+	switch arg.Policy {
+	case schedPolicies["fifo"], schedPolicies["rr"]:
+		if arg.Priority < 1 || arg.Priority > 99 {
+			return os.NewError("-sched fifo and rr need a priority between 1 and 99")
+		}
+	default:
+		if arg.Priority != 0 {
+			return os.NewError("-sched priority is only for fifo and rr")
+		}
+	}
+	return nil
+}
+
+/* checkCaps holds a job to the site's caps, on the master. */
+func checkCaps(arg *StartArg, caps *SiteCaps) os.Error {
+	for _, r := range arg.Rlimits {
+		max, ok := caps.Rlimits[r.Name]
+		if ok && (r.Cur > max || r.Max > max) {
+			return os.NewError(fmt.Sprintf("rlimit %s is capped at %s", r.Name, rlimString(max)))
+		}
+	}
+	if arg.Nice < caps.MinNice {
+		return os.NewError(fmt.Sprintf("nice is capped at %d", caps.MinNice))
+	}
+	if caps.Realtime {
+		return nil
+	}
+	if arg.Policy == schedPolicies["fifo"] || arg.Policy == schedPolicies["rr"] {
+		return os.NewError("realtime scheduling is not allowed here")
+	}
+	if arg.IoClass == ioClasses["rt"] {
+		return os.NewError("the realtime I/O class is not allowed here")
+	}
+	return nil
+}
+
+/* setSched puts the settings on this process and the calling thread. */
+func setSched(arg *jobSched) (err os.Error) {
+	for _, r := range arg.Rlimits {
+		rl := syscall.Rlimit{Cur: r.Cur, Max: r.Max}
+		if e := syscall.Setrlimit(rlimitNames[r.Name], &rl); e != 0 {
+			return &os.PathError{"setrlimit", r.Name, os.Errno(e)}
+		}
+	}
+	if arg.Nice != 0 {
+		_, _, e := syscall.RawSyscall(syscall.SYS_SETPRIORITY, syscall.PRIO_PROCESS, 0, uintptr(arg.Nice))
+		if e != 0 {
+			return &os.PathError{"setpriority", strconv.Itoa(arg.Nice), os.Errno(e)}
+		}
+	}
+	if arg.IoClass != 0 {
+		prio := arg.IoClass<<ioprioClassShift | arg.IoLevel
+		_, _, e := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+		if e != 0 {
+			return &os.PathError{"ioprio_set", strconv.Itoa(prio), os.Errno(e)}
+		}
+	}
+	if arg.Policy != 0 {
+		param := int32(arg.Priority)
+		_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, uintptr(arg.Policy), uintptr(unsafe.Pointer(&param)))
+		if e != 0 {
+			return &os.PathError{"sched_setscheduler", strconv.Itoa(arg.Policy), os.Errno(e)}
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+/* Each job gets its own staging directory, /tmp/xproc/<jobid>, so jobs
+ * on the same node never write over each other's files. With -p it is a
+ * tmpfs, and on a diskless node that is RAM, so it is held to the size
+ * of the files shipped plus some headroom for whatever the job writes.
+ * The runner takes it all down when its processes are done, the slave
+ * cleans up after a runner that didn't get that far, and a slave that
+ * starts up sweeps away whatever a previous one left behind. The runner
+ * holds a lock on a file in the directory while it lives, so the sweep
+ * can tell the leavings of a dead job from a live one of another slave
+ * on the node; the job ids alone can't, as each master counts from 1.
+ */
+
+const xprocBase = "/tmp/xproc"
+
+const stageLock = ".lock"
+
+func jobDir(jobid int) string {
+	return path.Join(xprocBase, strconv.Itoa(jobid))
+}
+
+/* lockStage takes the lock on a job's staging directory, before anything
+ * is mounted on it, and holds it as long as the file is open.
+ */
+func lockStage(dir string) (f *os.File, err os.Error) {
+	f, err = os.Open(path.Join(dir, stageLock), os.O_RDONLY|os.O_CREAT, 0600)
+	if err != nil {
+		return
+	}
+	syscall.CloseOnExec(f.Fd())
+	if e := syscall.Flock(f.Fd(), syscall.LOCK_EX|syscall.LOCK_NB); e != 0 {
+		f.Close()
+		return nil, &os.PathError{"flock", f.Name(), os.Errno(e)}
+	}
+	return
+}
+
+/* stageLive says whether a runner still holds dir. One that never took
+ * the lock died before it got anywhere.
+ */
+func stageLive(dir string) bool {
+	f, err := os.Open(path.Join(dir, stageLock), os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return syscall.Flock(f.Fd(), syscall.LOCK_EX|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+}
+
+/* stageSize is the size limit for a job's tmpfs. */
+func stageSize(total, headroom int64) int64 {
+	return total + total/4 + headroom
+}
+
+/* cleanStage unmounts and removes a job's staging directory. */
+func cleanStage(dir string) (err os.Error) {
+	syscall.Unmount(dir, syscall.MNT_DETACH)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		log.Printf("clean %s: %v\n", dir, err)
+	}
+	return
+}
+
+/* sweepStage removes everything in /tmp/xproc left by jobs that are no
+ * more, and leaves what a live runner holds.
+ */
+func sweepStage() {
+	d, err := os.Open(xprocBase, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+	for _, n := range names {
+		if _, err := strconv.Atoi(n); err != nil {
+			continue
+		}
+		dir := path.Join(xprocBase, n)
+		if stageLive(dir) {
+			continue
+		}
+		if DebugLevel > 0 {
+			log.Printf("sweep orphan %s\n", n)
+		}
+		cleanStage(dir)
+	}
+}
+
+func tmpfsOptions(size int64) string {
+	return fmt.Sprintf("mode=0700,size=%d", size)
+}
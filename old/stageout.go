@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"netchan"
+	"os"
+	"path"
+	"strings"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* Stage-out brings files the job wrote back to the client. With
+ * -stageout the runner, once its processes are done, bundles up the
+ * files in the job directory that match any of the patterns, along with
+ * anything in the stage-out directory, and sends the bundle back a piece
+ * at a time as cluster.StageData. By default the client unpacks each
+ * node's bundle under ./<jobid>/<node>/, or with -stageouttar writes it
+ * out as ./<jobid>/<node>.tar. A node sends no more than -stageoutmax
+ * bytes of files; what doesn't fit is left behind, and the client says
+ * so.
+ */
+
+func (arg *StartArg) stagingOut() bool {
+	return len(arg.StageOut) > 0 || arg.NodeRedirect
+}
+
+/* stageVisitor picks out the files to send back. */
+type stageVisitor struct {
+	base     string
+	patterns []string
+	max      int64
+	total    int64
+	entries  []bundle.Entry
+	skipped  int
+}
+
+func (v *stageVisitor) VisitDir(name string, f *os.FileInfo) bool {
+	return true
+}
+
+func (v *stageVisitor) VisitFile(name string, f *os.FileInfo) {
+	if !f.IsRegular() && !f.IsSymlink() {
+		return
+	}
+	rel := name[len(v.base)+1:]
+	if !v.match(rel) {
+		return
+	}
+	if v.total+f.Size > v.max {
+		v.skipped++
+		return
+	}
+	e, err := bundle.NewEntry(rel, name, f)
+	if err != nil {
+		return
+	}
+	v.total += e.DataSize()
+	v.entries = append(v.entries, e)
+}
+
+func (v *stageVisitor) match(rel string) bool {
+	if strings.HasPrefix(rel, stageoutDir+"/") {
+		return true
+	}
+	for _, p := range v.patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/* stageWriter sends what is written to it down the stage-out channel. */
+type stageWriter struct {
+	c chan cluster.StageData
+	d cluster.StageData
+}
+
+func (w *stageWriter) Write(b []byte) (int, os.Error) {
+	d := w.d
+	d.Data = make([]byte, len(b))
+	copy(d.Data, b)
+	w.c <- d
+	return len(b), nil
+}
+
+/* stageout sends the job's stage-out files from pathbase back to the client. */
+func stageout(arg *StartArg, imp *netchan.Importer, pathbase string) (err os.Error) {
+	c := make(chan cluster.StageData)
+	err = imp.Import("stageout", c, netchan.Send)
+	if err != nil {
+		return
+	}
+	v := &stageVisitor{base: pathbase, patterns: arg.StageOut, max: arg.StageOutMax}
+	path.Walk(pathbase, v, nil)
+	sw := &stageWriter{c: c, d: cluster.StageData{JobId: arg.JobId, Node: arg.NodeId}}
+	w, err := bufio.NewWriterSize(sw, cluster.StageChunk)
+	if err == nil {
+		err = bundle.Write(w, pathbase, v.entries)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	last := sw.d
+	last.Last = true
+	switch {
+	case err != nil:
+		last.Err = err.String()
+	case v.skipped > 0:
+		last.Err = fmt.Sprintf("%d files over the %d byte stage-out limit left behind", v.skipped, arg.StageOutMax)
+	}
+	c <- last
+	return
+}
+
+/* stageFailed tells the client there is nothing to come from this node. */
+func stageFailed(arg *StartArg, imp *netchan.Importer, msg string) {
+	c := make(chan cluster.StageData)
+	if imp.Import("stageout", c, netchan.Send) != nil {
+		return
+	}
+	c <- cluster.StageData{JobId: arg.JobId, Node: arg.NodeId, Last: true, Err: "job never ran: " + msg}
+}
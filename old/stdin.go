@@ -0,0 +1,47 @@
+package main
+
+import (
+	"netchan"
+	"os"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* The client's stdin comes to each rank that wants it under the job's
+ * -stdin mode on a channel of its own, named by cluster.StdinChan. The
+ * runner feeds it to the process through a pipe.
+ */
+
+/* stdinimport is the runner's side. It returns the file the process of
+ * the given rank should have as its stdin.
+ */
+func stdinimport(imp *netchan.Importer, arg *StartArg, rank int) (in *os.File, err os.Error) {
+	if !cluster.StdinWanted(arg.Stdin, rank) {
+		return os.Open("/dev/null", os.O_RDONLY, 0)
+	}
+	c := make(chan cluster.IoData)
+	err = imp.Import(cluster.StdinChan(rank), c, netchan.Recv)
+	if err != nil {
+		return
+	}
+	in, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	go func() {
+		defer w.Close()
+		for {
+			d := <-c
+			if len(d.Data) == 0 {
+				return
+			}
+			if _, err := w.Write(d.Data); err != nil {
+				/* the process stopped reading; keep draining so the client doesn't block */
+				for d := <-c; len(d.Data) > 0; d = <-c {
+				}
+				return
+			}
+		}
+	}()
+	return
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gproc-npe.googlecode.com/hg/bundle"
+)
+
+/* Not everything the takeout finds is worth shipping. Include and
+ * exclude rules, from gpconfig and from -include and -exclude, are
+ * globs matched against the full path of each file, or against its last
+ * element if the glob has no /. A file is left out if it matches an
+ * exclude rule and no include rule.
+ *
+ * Beyond that, a slave can say what its nodes already have. Started with
+ * -class and -provided, it reads a manifest in the format sha1sum writes,
+ *	<sha1> <path>
+ * checks each file against its hash, and sends what matches to the master
+ * when it registers. The master keeps the manifest of each slave, and for
+ * a class of node takes out of the bundle every file that all of them
+ * have with the same contents, putting a symlink to the node's own copy
+ * in its place so the job finds it at the usual path. Under -root the
+ * node's copy is at that path already and nothing takes its place.
+ *
+ * A manifest can go stale after the slave has read it. The files taken
+ * out go along in the StartArg with their hashes, and the slave checks
+ * them again before it starts the runner. If one has changed it says so,
+ * and the master forgets that slave's manifest and sends the node the
+ * whole bundle instead.
+ */
+
+type TakeoutRules struct {
+	Include []string
+	Exclude []string
+}
+
+var takeoutRules TakeoutRules
+
+func ruleMatch(rules []string, name string) bool {
+	_, last := path.Split(name)
+	for _, r := range rules {
+		target := name
+		if strings.Index(r, "/") < 0 {
+			target = last
+		}
+		if ok, _ := path.Match(r, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/* skip says whether the rules leave the named file behind. */
+func (t *TakeoutRules) skip(name string) bool {
+	return ruleMatch(t.Exclude, name) && !ruleMatch(t.Include, name)
+}
+
+func (t *TakeoutRules) add(include, exclude string) {
+	if include != "" {
+		t.Include = append(t.Include, strings.Split(include, ",", -1)...)
+	}
+	if exclude != "" {
+		t.Exclude = append(t.Exclude, strings.Split(exclude, ",", -1)...)
+	}
+}
+
+/* what each slave of each class already has, path to hash, on the master */
+var (
+	providedLock sync.Mutex
+	provided     = make(map[string]map[string]map[string]string)
+)
+
+/* setProvided records the manifest of slave id. A slave in a class with
+ * no manifest counts as having nothing.
+ */
+func setProvided(class, id string, files map[string]string) {
+	if class == "" {
+		return
+	}
+	if files == nil {
+		files = make(map[string]string)
+	}
+	providedLock.Lock()
+	defer providedLock.Unlock()
+	if provided[class] == nil {
+		provided[class] = make(map[string]map[string]string)
+	}
+	provided[class][id] = files
+}
+
+/* classProvided is what every slave of the class has, the same on all. */
+func classProvided(class string) (files map[string]string) {
+	providedLock.Lock()
+	defer providedLock.Unlock()
+	for _, have := range provided[class] {
+		if files == nil {
+			files = make(map[string]string)
+			for f, h := range have {
+				files[f] = h
+			}
+			continue
+		}
+		for f, h := range files {
+			if have[f] != h {
+				files[f] = "", false
+			}
+		}
+	}
+	return
+}
+
+/* A class can provide a whole toolchain, too much to read again on every
+ * launch. The slave keeps the hash of each provided file with the stat it
+ * had when hashed, and only hashes it again when that changes.
+ */
+type statHash struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime int64
+	hash         string
+}
+
+var (
+	hashCacheLock sync.Mutex
+	hashCache     = make(map[string]statHash)
+)
+
+func providedHash(name string) (hash string, err os.Error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	hashCacheLock.Lock()
+	c, ok := hashCache[name]
+	hashCacheLock.Unlock()
+	if ok && c.dev == fi.Dev && c.ino == fi.Ino && c.size == fi.Size &&
+		c.mtime == fi.Mtime_ns && c.ctime == fi.Ctime_ns {
+		return c.hash, nil
+	}
+	hash, err = hashFile(name)
+	if err != nil {
+		return
+	}
+	hashCacheLock.Lock()
+	hashCache[name] = statHash{fi.Dev, fi.Ino, fi.Size, fi.Mtime_ns, fi.Ctime_ns, hash}
+	hashCacheLock.Unlock()
+	return
+}
+
+/* checkProvided runs on the slave before a launch: it gives the first
+ * of the files taken out of the bundle that is no longer as the master
+ * thinks, if any.
+ */
+func checkProvided(files map[string]string) string {
+	for f, hash := range files {
+		if h, err := providedHash(f); err != nil || h != hash {
+			return f
+		}
+	}
+	return ""
+}
+
+/* loadProvided reads a slave's manifest, keeping the files that are still as it says. */
+func loadProvided(name string) (files map[string]string, err os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	files = make(map[string]string)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		hash, file := fields[0], strings.TrimLeft(fields[1], "*")
+		if h, err := providedHash(file); err != nil || h != hash {
+			log.Printf("provided: %s is not what %s says\n", file, name)
+			continue
+		}
+		files[file] = hash
+	}
+	return
+}
+
+/* stripProvided takes the files a node has out of a bundle, and says
+ * which they were, path to hash.
+ */
+func stripProvided(data []byte, have map[string]string, inroot bool) (out []byte, skipped map[string]string, err os.Error) {
+	if len(have) == 0 {
+		return data, nil, nil
+	}
+	var entries []bundle.Entry
+	var contents [][]byte
+	stripped := make(map[string]bool)
+	skipped = make(map[string]string)
+	err = bundle.Scan(bytes.NewBuffer(data), func(e *bundle.Entry, r io.Reader) os.Error {
+		if e.HardLink != "" && stripped[e.HardLink] {
+			/* the node has it under the name it was linked to */
+			entries = append(entries, bundle.Entry{Name: e.Name, Mode: syscall.S_IFLNK | 0777, Link: "/" + e.HardLink})
+			return nil
+		}
+		if e.HasData() {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			h := sha1.New()
+			err = bundle.WriteDense(h, e, bytes.NewBuffer(b))
+			if err != nil {
+				return err
+			}
+			if hash := fmt.Sprintf("%x", h.Sum()); have["/"+e.Name] == hash {
+				skipped["/"+e.Name] = hash
+				stripped[e.Name] = true
+				if !inroot {
+					entries = append(entries, bundle.Entry{Name: e.Name, Mode: syscall.S_IFLNK | 0777, Link: "/" + e.Name})
+				}
+				return nil
+			}
+			contents = append(contents, b)
+		}
+		entries = append(entries, *e)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	err = bundle.WriteHeader(&buf, entries)
+	if err != nil {
+		return
+	}
+	for _, b := range contents {
+		buf.Write(b)
+	}
+	return buf.Bytes(), skipped, nil
+}
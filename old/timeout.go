@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* A job with -time gets that long, from when the last node has been
+ * launched, before it is told to stop with SIGTERM; if it is still there
+ * after the grace period it gets SIGKILL. The master keeps the clock for
+ * the job as a whole and signals it through the slaves, which reach the
+ * whole cgroup or process group, and each runner keeps its own for its
+ * processes in case the master can't get through. Either way the job
+ * ends with statusTimedOut, which the client exits with.
+ *
+ * Getting the files to a node has its own limit, -launchtime, since a
+ * node that takes the files and never answers would otherwise hold up
+ * the launch of all the nodes after it.
+ */
+
+const statusTimedOut = cluster.StatusTimedOut
+
+/* parseTime reads a time in seconds: a plain number of seconds, a number
+ * with an s, m, h or d after it, or [[H:]M:]S.
+ */
+func parseTime(s string) (secs int64, err os.Error) {
+	if s == "" {
+		return
+	}
+	bad := os.NewError("bad time " + s)
+	if strings.Index(s, ":") >= 0 {
+		for _, f := range strings.Split(s, ":", -1) {
+			n, err := strconv.Atoi64(f)
+			if err != nil || n < 0 {
+				return 0, bad
+			}
+			secs = secs*60 + n
+		}
+		return
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 's':
+		mult = 1
+	case 'm':
+		mult = 60
+	case 'h':
+		mult = 60 * 60
+	case 'd':
+		mult = 24 * 60 * 60
+	default:
+		if s[len(s)-1] < '0' || s[len(s)-1] > '9' {
+			return 0, bad
+		}
+	}
+	if s[len(s)-1] < '0' || s[len(s)-1] > '9' {
+		s = s[:len(s)-1]
+	}
+	secs, err = strconv.Atoi64(s)
+	if err != nil || secs < 0 {
+		return 0, bad
+	}
+	return secs * mult, nil
+}
+
+type jobTimer struct {
+	lock    sync.Mutex
+	expired bool
+	stop    chan bool
+}
+
+/* startTimer calls signal with SIGTERM after limit seconds and with
+ * SIGKILL grace seconds after that, unless it is cancelled first. A limit
+ * of 0 means no limit.
+ */
+func startTimer(limit, grace int64, signal func(sig int)) *jobTimer {
+	t := &jobTimer{stop: make(chan bool, 1)}
+	if limit <= 0 {
+		return t
+	}
+	go func() {
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(limit * 1e9):
+		}
+		t.lock.Lock()
+		t.expired = true
+		t.lock.Unlock()
+		signal(syscall.SIGTERM)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(grace * 1e9):
+		}
+		signal(syscall.SIGKILL)
+	}()
+	return t
+}
+
+/* cancel stops the timer if it hasn't finished, and says whether it went off. */
+func (t *jobTimer) cancel() bool {
+	select {
+	case t.stop <- true:
+	default:
+	}
+	return t.fired()
+}
+
+func (t *jobTimer) fired() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.expired
+}
+
+/* launch hands the StartArg and the files to a slave and waits for its
+ * answer, for at most timeout seconds if timeout isn't 0. One launch at
+ * a time goes to a slave, and the next waits until the answer to this
+ * one is in, even if that comes too late, so that it doesn't get it.
+ */
+func launch(s SlaveInfo, arg *StartArg, data []byte, timeout int64) (r Res, err os.Error) {
+	rc := make(chan Res, 1)
+	s.ldlock.Lock()
+	go func() {
+		defer s.ldlock.Unlock()
+		s.ch <- *arg
+		s.dch <- data
+		rc <- <-s.rch
+	}()
+	var deadline <-chan int64
+	if timeout > 0 {
+		deadline = time.After(timeout * 1e9)
+	}
+	select {
+	case r = <-rc:
+	case <-deadline:
+		err = os.NewError("launch timed out")
+	}
+	return
+}
+
+/* signalPids is how the runner stops its processes when its own clock
+ * runs out. Each leads a process group, which gets the signal. With -ns
+ * pid the pids are the gproc inits of their namespaces, which pass the
+ * signal on.
+ */
+func signalPids(pids []int) func(sig int) {
+	return func(sig int) {
+		for _, pid := range pids {
+			syscall.Kill(-pid, sig)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTime(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		secs int64
+	}{
+		{"", 0},
+		{"90", 90},
+		{"30s", 30},
+		{"30m", 30 * 60},
+		{"2h", 2 * 60 * 60},
+		{"1d", 24 * 60 * 60},
+		{"5:00", 5 * 60},
+		{"1:02:03", 60*60 + 2*60 + 3},
+	} {
+		if secs, err := parseTime(tt.s); err != nil || secs != tt.secs {
+			t.Errorf("%q: got %d, %v; want %d", tt.s, secs, err, tt.secs)
+		}
+	}
+	for _, s := range []string{"5x", "x", "s", "5ss", "1.5h", "-5", "-5m", "1:x", "1::2"} {
+		if secs, err := parseTime(s); err == nil {
+			t.Errorf("%q: got %d, want an error", s, secs)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"netchan"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"gproc-npe.googlecode.com/hg/cluster"
+)
+
+/* -t (or sh) gives you a terminal on one node, for editors, top and gdb.
+ * The runner opens a pty and starts the command on the slave side as a
+ * session leader with the pty as its controlling terminal; everything
+ * else, the files and the name space, is set up just as for a normal
+ * exec. The client's end is in the cluster package: its terminal goes
+ * raw, and window size changes and signals come as cluster.TtyCtl on the
+ * node's tty channel.
+ */
+
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+func ioctl(fd, req int, arg uintptr) os.Error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), arg)
+	if e != 0 {
+		return os.Errno(e)
+	}
+	return nil
+}
+
+func setWinsize(fd, rows, cols int) os.Error {
+	ws := winsize{Row: uint16(rows), Col: uint16(cols)}
+	return ioctl(fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+func openpty() (master, slave *os.File, err os.Error) {
+	master, err = os.Open("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	var n uint32
+	err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if err != nil {
+		master.Close()
+		return
+	}
+	var unlock int32
+	err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err != nil {
+		master.Close()
+		return
+	}
+	slave, err = os.Open(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+	}
+	return
+}
+
+/* runtty is the runner side: start the command on a pty, relay it and
+ * return its exit status. The command leads its own session, so signals
+ * for it from kill come to us and we pass them on.
+ */
+func runtty(arg *StartArg, imp *netchan.Importer, wchan chan cluster.IoData, in *os.File, execpath, pathbase string) (status int, err os.Error) {
+	status = -1
+	master, slave, err := openpty()
+	if err != nil {
+		return
+	}
+	defer master.Close()
+	if arg.Rows > 0 {
+		setWinsize(master.Fd(), arg.Rows, arg.Cols)
+	}
+	c := make(chan cluster.TtyCtl)
+	err = imp.Import(cluster.TtyChan(arg.NodeId), c, netchan.Recv)
+	if err != nil {
+		slave.Close()
+		return
+	}
+	p, err := os.StartProcess("/proc/self/exe", append(prepArgs(arg, execpath, pathbase), arg.Args...), &os.ProcAttr{
+		Env:   arg.Env,
+		Files: []*os.File{slave, slave, slave},
+		Sys:   &syscall.SysProcAttr{Setsid: true, Setctty: true, Cloneflags: procCloneflags(arg.Namespaces) &^ syscall.CLONE_NEWPID},
+	})
+	slave.Close()
+	if err != nil {
+		return
+	}
+	go func() {
+		for {
+			t := <-c
+			if t.Rows > 0 {
+				setWinsize(master.Fd(), t.Rows, t.Cols)
+			}
+			if t.Sig > 0 {
+				syscall.Kill(-p.Pid, t.Sig)
+			}
+		}
+	}()
+	go func() {
+		defer in.Close()
+		if _, err := io.Copy(master, in); err != nil {
+			log.Printf("tty: %v\n", err)
+		}
+		/* EOF on the client's stdin is ^D at the remote end */
+		master.Write([]byte{4})
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	/* the pty is raw bytes in both directions; no lines to wait for */
+	host, _ := os.Hostname()
+	d := cluster.IoData{JobId: arg.JobId, Node: arg.NodeId, Src: arg.NodeId, Host: host, Fd: 1}
+	go relay(d, true, master, wchan, &wg)
+	w, err := p.Wait(0)
+	if err == nil {
+		status = w.ExitStatus()
+	}
+	/* reading the master gets EIO once the last slave fd is gone */
+	wg.Wait()
+	return
+}
@@ -0,0 +1,316 @@
+package p9
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A Client reads a tree served over 9P2000.L. It is an FS itself, so a
+// Server can pass a remote tree on.
+type Client struct {
+	rw    io.ReadWriter
+	msize uint32
+	root  uint32
+
+	lock    sync.Mutex
+	wlock   sync.Mutex
+	tag     uint16
+	fid     uint32
+	pending map[uint16]chan *Fcall
+	err     os.Error
+}
+
+// NewClient starts a session on rw and attaches to aname.
+func NewClient(rw io.ReadWriter, uname, aname string) (c *Client, err os.Error) {
+	c = &Client{rw: rw, msize: 64 << 10, pending: make(map[uint16]chan *Fcall)}
+	err = WriteFcall(rw, &Fcall{Type: Tversion, Tag: NoTag, Msize: c.msize, Version: Version})
+	if err != nil {
+		return
+	}
+	r, err := ReadFcall(rw)
+	if err != nil {
+		return
+	}
+	if r.Type != Rversion || r.Version != Version {
+		return nil, os.NewError("9p: server doesn't speak " + Version)
+	}
+	if r.Msize < c.msize {
+		c.msize = r.Msize
+	}
+	go c.reader()
+	c.root = c.newFid()
+	_, err = c.rpc(&Fcall{Type: Tattach, Fid: c.root, Afid: NoFid, Uname: uname, Aname: aname})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *Client) reader() {
+	for {
+		r, err := ReadFcall(c.rw)
+		c.lock.Lock()
+		if err != nil {
+			c.err = err
+			for t, ch := range c.pending {
+				ch <- nil
+				c.pending[t] = nil, false
+			}
+			c.lock.Unlock()
+			return
+		}
+		ch, ok := c.pending[r.Tag]
+		c.pending[r.Tag] = nil, false
+		c.lock.Unlock()
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+func (c *Client) newFid() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fid++
+	return c.fid
+}
+
+func (c *Client) rpc(t *Fcall) (r *Fcall, err os.Error) {
+	ch := make(chan *Fcall, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		err = c.err
+		c.lock.Unlock()
+		return
+	}
+	for {
+		c.tag++
+		if _, busy := c.pending[c.tag]; !busy && c.tag != NoTag {
+			break
+		}
+	}
+	t.Tag = c.tag
+	c.pending[t.Tag] = ch
+	c.lock.Unlock()
+
+	c.wlock.Lock()
+	err = WriteFcall(c.rw, t)
+	c.wlock.Unlock()
+	if err != nil {
+		return
+	}
+	r = <-ch
+	switch {
+	case r == nil:
+		err = c.err
+	case r.Type == Rlerror:
+		err = os.Errno(r.Ecode)
+		r = nil
+	case r.Type != t.Type+1:
+		err = os.NewError("9p: reply of the wrong type")
+		r = nil
+	}
+	return
+}
+
+// walk gets a new fid for name.
+func (c *Client) walk(name string) (fid uint32, err os.Error) {
+	var names []string
+	for _, s := range strings.Split(name, "/", -1) {
+		if s != "" {
+			names = append(names, s)
+		}
+	}
+	fid = c.newFid()
+	from := c.root
+	for first := true; first || len(names) > 0; first = false {
+		n := len(names)
+		if n > MaxWalk {
+			n = MaxWalk
+		}
+		r, err := c.rpc(&Fcall{Type: Twalk, Fid: from, Newfid: fid, Wname: names[:n]})
+		if err != nil {
+			return 0, err
+		}
+		if len(r.Wqid) != n {
+			if from == fid {
+				c.clunk(fid)
+			}
+			return 0, os.ENOENT
+		}
+		from = fid
+		names = names[n:]
+	}
+	return
+}
+
+func (c *Client) clunk(fid uint32) {
+	c.rpc(&Fcall{Type: Tclunk, Fid: fid})
+}
+
+func (c *Client) Stat(name string) (d *Dir, err os.Error) {
+	fid, err := c.walk(name)
+	if err != nil {
+		return
+	}
+	defer c.clunk(fid)
+	r, err := c.rpc(&Fcall{Type: Tgetattr, Fid: fid, Mask: getattrBasic})
+	if err != nil {
+		return
+	}
+	_, last := splitName(name)
+	a := r.Attr
+	return &Dir{Name: last, Mode: a.Mode, Uid: a.Uid, Gid: a.Gid, Size: a.Size, Mtime: a.Mtime, Ino: r.Qid.Path}, nil
+}
+
+// ReadDir lists a directory. Only the Name, Ino and the type bits of
+// Mode are filled in; Stat has the rest.
+func (c *Client) ReadDir(name string) (dir []Dir, err os.Error) {
+	fid, err := c.walk(name)
+	if err != nil {
+		return
+	}
+	defer c.clunk(fid)
+	_, err = c.rpc(&Fcall{Type: Tlopen, Fid: fid, Flags: syscall.O_RDONLY})
+	if err != nil {
+		return
+	}
+	var off uint64
+	for {
+		r, err := c.rpc(&Fcall{Type: Treaddir, Fid: fid, Offset: off, Count: c.msize - IOHdrSz})
+		if err != nil {
+			return nil, err
+		}
+		ents, err := ParseDirents(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		if len(ents) == 0 {
+			return dir, nil
+		}
+		for _, e := range ents {
+			off = e.Offset
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			mode := uint32(syscall.S_IFREG)
+			switch {
+			case e.Qid.Type&QTDIR != 0:
+				mode = syscall.S_IFDIR
+			case e.Qid.Type&QTSYMLINK != 0:
+				mode = syscall.S_IFLNK
+			}
+			dir = append(dir, Dir{Name: e.Name, Mode: mode, Ino: e.Qid.Path})
+		}
+	}
+	return
+}
+
+func (c *Client) Readlink(name string) (target string, err os.Error) {
+	fid, err := c.walk(name)
+	if err != nil {
+		return
+	}
+	defer c.clunk(fid)
+	r, err := c.rpc(&Fcall{Type: Treadlink, Fid: fid})
+	if err != nil {
+		return
+	}
+	return r.Target, nil
+}
+
+// Hash asks the server for the SHA-1 of what is in the named file,
+// which it has only if its FS is a Hasher.
+func (c *Client) Hash(name string) (sum []byte, err os.Error) {
+	fid, err := c.walk(name)
+	if err != nil {
+		return
+	}
+	defer c.clunk(fid)
+	xfid := c.newFid()
+	r, err := c.rpc(&Fcall{Type: Txattrwalk, Fid: fid, Newfid: xfid, Name: HashAttr})
+	if err != nil {
+		return
+	}
+	defer c.clunk(xfid)
+	if r.Size > uint64(c.msize-IOHdrSz) {
+		return nil, os.NewError("9p: hash too big")
+	}
+	r, err = c.rpc(&Fcall{Type: Tread, Fid: xfid, Count: uint32(r.Size)})
+	if err != nil {
+		return
+	}
+	return r.Data, nil
+}
+
+// A RemoteFile is a file open on the server
+type RemoteFile struct {
+	c   *Client
+	fid uint32
+}
+
+func (c *Client) Open(name string) (File, os.Error) {
+	fid, err := c.walk(name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.rpc(&Fcall{Type: Tlopen, Fid: fid, Flags: syscall.O_RDONLY})
+	if err != nil {
+		c.clunk(fid)
+		return nil, err
+	}
+	return &RemoteFile{c, fid}, nil
+}
+
+func (f *RemoteFile) ReadAt(b []byte, off int64) (n int, err os.Error) {
+	for n < len(b) {
+		count := uint32(len(b) - n)
+		if count > f.c.msize-IOHdrSz {
+			count = f.c.msize - IOHdrSz
+		}
+		r, err := f.c.rpc(&Fcall{Type: Tread, Fid: f.fid, Offset: uint64(off) + uint64(n), Count: count})
+		if err != nil {
+			return n, err
+		}
+		if len(r.Data) == 0 {
+			return n, os.EOF
+		}
+		n += copy(b[n:], r.Data)
+	}
+	return
+}
+
+func (f *RemoteFile) Close() os.Error {
+	f.c.clunk(f.fid)
+	return nil
+}
+
+// ReadFile reads all of the named file.
+func (c *Client) ReadFile(name string) (b []byte, err os.Error) {
+	d, err := c.Stat(name)
+	if err != nil {
+		return
+	}
+	f, err := c.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	b = make([]byte, d.Size)
+	n, err := f.ReadAt(b, 0)
+	if err == os.EOF {
+		err = nil
+	}
+	return b[:n], err
+}
+
+func splitName(name string) (dir, last string) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
@@ -0,0 +1,380 @@
+// Package p9 is enough of 9P2000.L to serve a read-only tree of files
+// and to read one: a Server that serves an FS over any io.ReadWriter,
+// and a Client that is itself an FS. Neither cares what the stream is,
+// so the two can be run against each other in one process over a pipe.
+// gproc uses them to let a job's files be fetched as they are opened
+// instead of all shipped up front.
+package p9
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Message types
+const (
+	Tlerror    = 6
+	Rlerror    = 7
+	Tstatfs    = 8
+	Rstatfs    = 9
+	Tlopen     = 12
+	Rlopen     = 13
+	Treadlink  = 22
+	Rreadlink  = 23
+	Tgetattr   = 24
+	Rgetattr   = 25
+	Txattrwalk = 30
+	Rxattrwalk = 31
+	Treaddir   = 40
+	Rreaddir   = 41
+	Tversion   = 100
+	Rversion   = 101
+	Tattach    = 104
+	Rattach    = 105
+	Tflush     = 108
+	Rflush     = 109
+	Twalk      = 110
+	Rwalk      = 111
+	Tread      = 116
+	Rread      = 117
+	Tclunk     = 120
+	Rclunk     = 121
+)
+
+// Qid types
+const (
+	QTDIR     = 0x80
+	QTSYMLINK = 0x02
+	QTFILE    = 0x00
+)
+
+const (
+	Version      = "9P2000.L"
+	NoTag        = 0xffff
+	NoFid        = 0xffffffff
+	MaxWalk      = 16
+	IOHdrSz      = 24 // room for the header of Rread and Rreaddir
+	getattrBasic = 0x7ff
+)
+
+// A Qid is the server's name for a file
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// An Attr is the part of Rgetattr we use
+type Attr struct {
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Nlink uint64
+	Size  uint64
+	Mtime int64 // ns
+}
+
+// A Dirent is one entry of Rreaddir
+type Dirent struct {
+	Qid    Qid
+	Offset uint64
+	Type   uint8
+	Name   string
+}
+
+// An Fcall is a 9P message. Only the fields of its Type mean anything.
+type Fcall struct {
+	Type    uint8
+	Tag     uint16
+	Fid     uint32
+	Newfid  uint32
+	Afid    uint32
+	Msize   uint32
+	Version string
+	Uname   string
+	Aname   string
+	Wname   []string
+	Wqid    []Qid
+	Qid     Qid
+	Iounit  uint32
+	Flags   uint32
+	Mask    uint64
+	Attr    Attr
+	Offset  uint64
+	Count   uint32
+	Data    []byte
+	Target  string
+	Name    string
+	Size    uint64
+	Ecode   uint32
+	Oldtag  uint16
+}
+
+// Dirents packs entries into Rreaddir data, as many as fit in count bytes.
+func Dirents(ents []Dirent, count uint32) []byte {
+	var b buf
+	for _, d := range ents {
+		if uint32(len(b)+13+8+1+2+len(d.Name)) > count {
+			break
+		}
+		b.qid(d.Qid)
+		b.u64(d.Offset)
+		b.u8(d.Type)
+		b.str(d.Name)
+	}
+	return b
+}
+
+// ParseDirents unpacks Rreaddir data.
+func ParseDirents(data []byte) (ents []Dirent, err os.Error) {
+	r := &reader{b: data}
+	for len(r.b) > 0 && r.err == nil {
+		var d Dirent
+		d.Qid = r.qid()
+		d.Offset = r.u64()
+		d.Type = r.u8()
+		d.Name = r.str()
+		if r.err == nil {
+			ents = append(ents, d)
+		}
+	}
+	return ents, r.err
+}
+
+type buf []byte
+
+func (b *buf) u8(v uint8) { *b = append(*b, v) }
+func (b *buf) u16(v uint16) {
+	var x [2]byte
+	binary.LittleEndian.PutUint16(x[:], v)
+	*b = append(*b, x[:]...)
+}
+func (b *buf) u32(v uint32) {
+	var x [4]byte
+	binary.LittleEndian.PutUint32(x[:], v)
+	*b = append(*b, x[:]...)
+}
+func (b *buf) u64(v uint64) {
+	var x [8]byte
+	binary.LittleEndian.PutUint64(x[:], v)
+	*b = append(*b, x[:]...)
+}
+func (b *buf) str(s string) {
+	b.u16(uint16(len(s)))
+	*b = append(*b, s...)
+}
+func (b *buf) qid(q Qid) {
+	b.u8(q.Type)
+	b.u32(q.Version)
+	b.u64(q.Path)
+}
+
+var errShort = os.NewError("9p: short message")
+
+type reader struct {
+	b   []byte
+	err os.Error
+}
+
+func (r *reader) get(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errShort
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) u8() uint8   { return r.get(1)[0] }
+func (r *reader) u16() uint16 { return binary.LittleEndian.Uint16(r.get(2)) }
+func (r *reader) u32() uint32 { return binary.LittleEndian.Uint32(r.get(4)) }
+func (r *reader) u64() uint64 { return binary.LittleEndian.Uint64(r.get(8)) }
+func (r *reader) str() string { return string(r.get(int(r.u16()))) }
+func (r *reader) qid() (q Qid) {
+	q.Type = r.u8()
+	q.Version = r.u32()
+	q.Path = r.u64()
+	return
+}
+
+// WriteFcall writes f to w as one message.
+func WriteFcall(w io.Writer, f *Fcall) os.Error {
+	b := buf(make([]byte, 4, 64))
+	b.u8(f.Type)
+	b.u16(f.Tag)
+	switch f.Type {
+	case Tversion, Rversion:
+		b.u32(f.Msize)
+		b.str(f.Version)
+	case Tattach:
+		b.u32(f.Fid)
+		b.u32(f.Afid)
+		b.str(f.Uname)
+		b.str(f.Aname)
+		b.u32(NoFid)
+	case Rattach, Rlopen:
+		b.qid(f.Qid)
+		if f.Type == Rlopen {
+			b.u32(f.Iounit)
+		}
+	case Twalk:
+		b.u32(f.Fid)
+		b.u32(f.Newfid)
+		b.u16(uint16(len(f.Wname)))
+		for _, n := range f.Wname {
+			b.str(n)
+		}
+	case Rwalk:
+		b.u16(uint16(len(f.Wqid)))
+		for _, q := range f.Wqid {
+			b.qid(q)
+		}
+	case Tlopen:
+		b.u32(f.Fid)
+		b.u32(f.Flags)
+	case Tgetattr:
+		b.u32(f.Fid)
+		b.u64(f.Mask)
+	case Rgetattr:
+		a := f.Attr
+		b.u64(getattrBasic)
+		b.qid(f.Qid)
+		b.u32(a.Mode)
+		b.u32(a.Uid)
+		b.u32(a.Gid)
+		b.u64(a.Nlink)
+		b.u64(0) // rdev
+		b.u64(a.Size)
+		b.u64(4096)
+		b.u64((a.Size + 511) / 512)
+		for i := 0; i < 3; i++ { // atime, mtime, ctime
+			b.u64(uint64(a.Mtime / 1e9))
+			b.u64(uint64(a.Mtime % 1e9))
+		}
+		for i := 0; i < 4; i++ { // btime, gen, data_version
+			b.u64(0)
+		}
+	case Tread, Treaddir:
+		b.u32(f.Fid)
+		b.u64(f.Offset)
+		b.u32(f.Count)
+	case Rread, Rreaddir:
+		b.u32(uint32(len(f.Data)))
+		b = append(b, f.Data...)
+	case Treadlink, Tclunk, Tstatfs:
+		b.u32(f.Fid)
+	case Rreadlink:
+		b.str(f.Target)
+	case Txattrwalk:
+		b.u32(f.Fid)
+		b.u32(f.Newfid)
+		b.str(f.Name)
+	case Rxattrwalk:
+		b.u64(f.Size)
+	case Tflush:
+		b.u16(f.Oldtag)
+	case Rlerror:
+		b.u32(f.Ecode)
+	case Rclunk, Rflush:
+	default:
+		return os.NewError("9p: can't write message type " + strconv.Itoa(int(f.Type)))
+	}
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)))
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFcall reads one message from r.
+func ReadFcall(r io.Reader) (f *Fcall, err os.Error) {
+	var size [4]byte
+	_, err = io.ReadFull(r, size[:])
+	if err != nil {
+		return
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 7 || n > 1<<24 {
+		return nil, os.NewError("9p: bad message size")
+	}
+	b := make([]byte, n-4)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return
+	}
+	m := &reader{b: b}
+	f = &Fcall{Type: m.u8(), Tag: m.u16()}
+	switch f.Type {
+	case Tversion, Rversion:
+		f.Msize = m.u32()
+		f.Version = m.str()
+	case Tattach:
+		f.Fid = m.u32()
+		f.Afid = m.u32()
+		f.Uname = m.str()
+		f.Aname = m.str()
+	case Rattach:
+		f.Qid = m.qid()
+	case Rlopen:
+		f.Qid = m.qid()
+		f.Iounit = m.u32()
+	case Twalk:
+		f.Fid = m.u32()
+		f.Newfid = m.u32()
+		f.Wname = make([]string, m.u16())
+		for i := range f.Wname {
+			f.Wname[i] = m.str()
+		}
+	case Rwalk:
+		f.Wqid = make([]Qid, m.u16())
+		for i := range f.Wqid {
+			f.Wqid[i] = m.qid()
+		}
+	case Tlopen:
+		f.Fid = m.u32()
+		f.Flags = m.u32()
+	case Tgetattr:
+		f.Fid = m.u32()
+		f.Mask = m.u64()
+	case Rgetattr:
+		m.u64()
+		f.Qid = m.qid()
+		f.Attr.Mode = m.u32()
+		f.Attr.Uid = m.u32()
+		f.Attr.Gid = m.u32()
+		f.Attr.Nlink = m.u64()
+		m.u64()
+		f.Attr.Size = m.u64()
+		m.u64()
+		m.u64()
+		m.u64()
+		m.u64()
+		sec, nsec := m.u64(), m.u64()
+		f.Attr.Mtime = int64(sec)*1e9 + int64(nsec)
+	case Tread, Treaddir:
+		f.Fid = m.u32()
+		f.Offset = m.u64()
+		f.Count = m.u32()
+	case Rread, Rreaddir:
+		f.Data = m.get(int(m.u32()))
+	case Treadlink, Tclunk, Tstatfs:
+		f.Fid = m.u32()
+	case Rreadlink:
+		f.Target = m.str()
+	case Txattrwalk:
+		f.Fid = m.u32()
+		f.Newfid = m.u32()
+		f.Name = m.str()
+	case Rxattrwalk:
+		f.Size = m.u64()
+	case Tflush:
+		f.Oldtag = m.u16()
+	case Rlerror:
+		f.Ecode = m.u32()
+	case Rclunk, Rflush:
+	default:
+		// the Server answers these with an error
+	}
+	return f, m.err
+}
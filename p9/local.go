@@ -0,0 +1,109 @@
+package p9
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// A LocalFS serves the named files and trees of the local file system,
+// along with the directories leading to them and nothing else. Hide, if
+// set, can hide more.
+type LocalFS struct {
+	Allow []string
+	Hide  func(name string) bool
+}
+
+func (l *LocalFS) visible(name string) bool {
+	if name == "/" {
+		return true
+	}
+	if l.Hide != nil && l.Hide(name) {
+		return false
+	}
+	for _, a := range l.Allow {
+		if name == a || strings.HasPrefix(name, a+"/") || strings.HasPrefix(a, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func localDir(fi *os.FileInfo) *Dir {
+	return &Dir{
+		Name:  fi.Name,
+		Mode:  fi.Mode,
+		Uid:   uint32(fi.Uid),
+		Gid:   uint32(fi.Gid),
+		Size:  uint64(fi.Size),
+		Mtime: fi.Mtime_ns,
+		Ino:   fi.Ino,
+	}
+}
+
+func (l *LocalFS) Stat(name string) (*Dir, os.Error) {
+	if !l.visible(name) {
+		return nil, os.ENOENT
+	}
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return localDir(fi), nil
+}
+
+func (l *LocalFS) ReadDir(name string) (dir []Dir, err os.Error) {
+	if !l.visible(name) {
+		return nil, os.ENOENT
+	}
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return
+	}
+	for i := range fis {
+		fi := &fis[i]
+		if l.visible(path.Join(name, fi.Name)) {
+			dir = append(dir, *localDir(fi))
+		}
+	}
+	return
+}
+
+func (l *LocalFS) Open(name string) (File, os.Error) {
+	if !l.visible(name) {
+		return nil, os.ENOENT
+	}
+	return os.Open(name, os.O_RDONLY, 0)
+}
+
+func (l *LocalFS) Readlink(name string) (string, os.Error) {
+	if !l.visible(name) {
+		return "", os.ENOENT
+	}
+	return os.Readlink(name)
+}
+
+// Hash reads the file through, which is cheaper here than sending it.
+func (l *LocalFS) Hash(name string) ([]byte, os.Error) {
+	if !l.visible(name) {
+		return nil, os.ENOENT
+	}
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(), nil
+}
@@ -0,0 +1,175 @@
+package p9
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+// serve makes a tree under a scratch directory, serves the part of it
+// in allow over a pipe, and returns a client of it and the directory.
+func serve(t *testing.T, allow ...string) (c *Client, dir string, clean func()) {
+	dir, err := ioutil.TempDir("", "p9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(path.Join(dir, "bin"), 0755)
+	os.MkdirAll(path.Join(dir, "secret"), 0700)
+	ioutil.WriteFile(path.Join(dir, "bin", "prog"), bytes.Repeat([]byte("0123456789"), 20000), 0755)
+	ioutil.WriteFile(path.Join(dir, "bin", "small"), []byte("small\n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "secret", "key"), []byte("hidden"), 0600)
+	os.Symlink("prog", path.Join(dir, "bin", "link"))
+
+	for i, a := range allow {
+		allow[i] = path.Join(dir, a)
+	}
+	cs, ss := net.Pipe()
+	go (&Server{FS: &LocalFS{Allow: allow}}).Serve(ss)
+	c, err = NewClient(cs, "", "/")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c, dir, func() {
+		cs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	c, dir, clean := serve(t, "bin")
+	defer clean()
+	for _, n := range []string{"prog", "small"} {
+		name := path.Join(dir, "bin", n)
+		want, _ := ioutil.ReadFile(name)
+		got, err := c.ReadFile(name)
+		if err != nil {
+			t.Errorf("ReadFile %s: %v", n, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes, want %d", n, len(got), len(want))
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	c, dir, clean := serve(t, "bin")
+	defer clean()
+	d, err := c.Stat(path.Join(dir, "bin", "small"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if d.Size != 6 || d.Mode&0777 != 0644 || d.IsDir() {
+		t.Errorf("got %+v", d)
+	}
+	d, err = c.Stat(path.Join(dir, "bin"))
+	if err != nil || !d.IsDir() {
+		t.Errorf("bin: got %+v, %v", d, err)
+	}
+	d, err = c.Stat(path.Join(dir, "bin", "link"))
+	if err != nil || !d.IsLink() {
+		t.Errorf("link: got %+v, %v", d, err)
+	}
+	target, err := c.Readlink(path.Join(dir, "bin", "link"))
+	if err != nil || target != "prog" {
+		t.Errorf("Readlink: got %q, %v", target, err)
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	c, dir, clean := serve(t, "bin")
+	defer clean()
+	ents, err := c.ReadDir(path.Join(dir, "bin"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	sort.SortStrings(names)
+	if len(names) != 3 || names[0] != "link" || names[1] != "prog" || names[2] != "small" {
+		t.Errorf("got %v", names)
+	}
+	// only what leads to bin shows above it
+	ents, err = c.ReadDir(dir)
+	if err != nil || len(ents) != 1 || ents[0].Name != "bin" {
+		t.Errorf("%s: got %v, %v", dir, ents, err)
+	}
+}
+
+func TestHidden(t *testing.T) {
+	c, dir, clean := serve(t, "bin")
+	defer clean()
+	for _, n := range []string{"secret", "secret/key"} {
+		if _, err := c.Stat(path.Join(dir, n)); err == nil {
+			t.Errorf("%s can be seen", n)
+		}
+	}
+	if _, err := c.ReadFile(path.Join(dir, "secret", "key")); err == nil {
+		t.Error("secret/key can be read")
+	}
+}
+
+func TestHash(t *testing.T) {
+	c, dir, clean := serve(t, "bin")
+	defer clean()
+	name := path.Join(dir, "bin", "prog")
+	b, _ := ioutil.ReadFile(name)
+	h := sha1.New()
+	h.Write(b)
+	sum, err := c.Hash(name)
+	if err != nil || !bytes.Equal(sum, h.Sum()) {
+		t.Errorf("Hash: got %x, %v; want %x", sum, err, h.Sum())
+	}
+	if _, err := c.Hash(path.Join(dir, "secret", "key")); err == nil {
+		t.Error("secret/key can be hashed")
+	}
+	// a Client passes it on
+	cs, ss := net.Pipe()
+	defer cs.Close()
+	go (&Server{FS: c}).Serve(ss)
+	c2, err := NewClient(cs, "", "/")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if sum, err := c2.Hash(name); err != nil || !bytes.Equal(sum, h.Sum()) {
+		t.Errorf("Hash through a Client: got %x, %v", sum, err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c, dir, clean := serve(t, "bin")
+	defer clean()
+	name := path.Join(dir, "bin", "prog")
+	want, _ := ioutil.ReadFile(name)
+	f, err := c.Open(name)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	done := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			defer func() { done <- true }()
+			off := int64(i * 1000)
+			b := make([]byte, 5000)
+			n, err := f.ReadAt(b, off)
+			if err != nil && err != os.EOF || !bytes.Equal(b[:n], want[off:off+int64(n)]) {
+				t.Errorf("ReadAt %d: %d bytes, %v", off, n, err)
+			}
+			// and opens of their own at the same time
+			if _, err := c.ReadFile(name); err != nil {
+				t.Errorf("ReadFile: %v", err)
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+}
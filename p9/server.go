@@ -0,0 +1,345 @@
+package p9
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A Dir describes a file in an FS. Mode has the type bits as in stat.
+type Dir struct {
+	Name  string
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Size  uint64
+	Mtime int64 // ns
+	Ino   uint64
+}
+
+func (d *Dir) IsDir() bool  { return d.Mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (d *Dir) IsLink() bool { return d.Mode&syscall.S_IFMT == syscall.S_IFLNK }
+
+// Qid is the Qid a Server gives d
+func (d *Dir) Qid() Qid {
+	q := Qid{Type: QTFILE, Version: uint32(d.Mtime / 1e9), Path: d.Ino}
+	switch {
+	case d.IsDir():
+		q.Type = QTDIR
+	case d.IsLink():
+		q.Type = QTSYMLINK
+	}
+	return q
+}
+
+// A File is an open regular file of an FS
+type File interface {
+	ReadAt(b []byte, off int64) (int, os.Error)
+	Close() os.Error
+}
+
+// An FS is a read-only tree of files. Names are absolute and clean.
+type FS interface {
+	Stat(name string) (*Dir, os.Error)
+	ReadDir(name string) ([]Dir, os.Error)
+	Open(name string) (File, os.Error)
+	Readlink(name string) (string, os.Error)
+}
+
+// HashAttr is the extended attribute whose value is the SHA-1 of a
+// file's contents. A Server has it for the files of an FS that is a
+// Hasher, and no others.
+const HashAttr = "user.gproc.sha1"
+
+// A Hasher is an FS that can say what is in a file without sending it.
+type Hasher interface {
+	Hash(name string) ([]byte, os.Error)
+}
+
+// A Server serves an FS to one client connection
+type Server struct {
+	FS    FS
+	Msize uint32
+
+	lock    sync.Mutex
+	wlock   sync.Mutex
+	fids    map[uint32]*sfid
+	pending sync.WaitGroup
+}
+
+// An sfid is a fid the client has. Requests on the same fid can be
+// answered at once, so what is open on it is kept under lock.
+type sfid struct {
+	name  string
+	lock  sync.Mutex
+	file  File
+	dir   []Dir
+	xattr []byte
+	open  bool
+}
+
+// close closes what is open on f.
+func (f *sfid) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.dir = nil
+}
+
+// Serve answers 9P requests from rw until it fails. Requests are
+// answered concurrently, as a slow Open shouldn't hold up the rest,
+// except for Tversion, which starts the session over and so waits for
+// everything before it and holds up everything after.
+func (s *Server) Serve(rw io.ReadWriter) os.Error {
+	s.fids = make(map[uint32]*sfid)
+	if s.Msize == 0 {
+		s.Msize = 64 << 10
+	}
+	reply := func(t, r *Fcall) {
+		r.Tag = t.Tag
+		s.wlock.Lock()
+		WriteFcall(rw, r)
+		s.wlock.Unlock()
+	}
+	for {
+		t, err := ReadFcall(rw)
+		if err != nil {
+			s.pending.Wait()
+			s.clunkAll()
+			return err
+		}
+		if t.Type == Tversion {
+			s.pending.Wait()
+			reply(t, s.answer(t))
+			continue
+		}
+		s.pending.Add(1)
+		go func(t *Fcall) {
+			reply(t, s.answer(t))
+			s.pending.Done()
+		}(t)
+	}
+	return nil
+}
+
+func (s *Server) clunkAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for n, f := range s.fids {
+		f.close()
+		s.fids[n] = nil, false
+	}
+}
+
+func (s *Server) fid(n uint32) (*sfid, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, ok := s.fids[n]
+	return f, ok
+}
+
+func (s *Server) setFid(n uint32, f *sfid) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fids[n] = f
+}
+
+func rerror(err os.Error) *Fcall {
+	e := syscall.EIO
+	switch v := err.(type) {
+	case os.Errno:
+		e = int(v)
+	case *os.PathError:
+		if n, ok := v.Error.(os.Errno); ok {
+			e = int(n)
+		}
+	}
+	return &Fcall{Type: Rlerror, Ecode: uint32(e)}
+}
+
+func errno(e int) *Fcall {
+	return &Fcall{Type: Rlerror, Ecode: uint32(e)}
+}
+
+func join(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+func (s *Server) answer(t *Fcall) *Fcall {
+	switch t.Type {
+	case Tversion:
+		msize := t.Msize
+		if msize > s.Msize {
+			msize = s.Msize
+		}
+		if !strings.HasPrefix(t.Version, Version) {
+			return &Fcall{Type: Rversion, Msize: msize, Version: "unknown"}
+		}
+		s.clunkAll()
+		s.Msize = msize
+		return &Fcall{Type: Rversion, Msize: msize, Version: Version}
+	case Tattach:
+		d, err := s.FS.Stat("/")
+		if err != nil {
+			return rerror(err)
+		}
+		s.setFid(t.Fid, &sfid{name: "/"})
+		return &Fcall{Type: Rattach, Qid: d.Qid()}
+	case Tflush:
+		return &Fcall{Type: Rflush}
+	}
+	f, ok := s.fid(t.Fid)
+	if !ok {
+		return errno(syscall.EBADF)
+	}
+	switch t.Type {
+	case Txattrwalk:
+		// only the hash; ENODATA for the rest lets exec go ahead
+		// without file capabilities
+		h, ok := s.FS.(Hasher)
+		if !ok || t.Name != HashAttr {
+			return errno(syscall.ENODATA)
+		}
+		sum, err := h.Hash(f.name)
+		if err != nil {
+			return rerror(err)
+		}
+		s.setFid(t.Newfid, &sfid{name: f.name, xattr: sum, open: true})
+		return &Fcall{Type: Rxattrwalk, Size: uint64(len(sum))}
+	case Twalk:
+		name := f.name
+		var qids []Qid
+		for _, w := range t.Wname {
+			switch w {
+			case ".":
+				continue
+			case "..":
+				if i := strings.LastIndex(name, "/"); i > 0 {
+					name = name[:i]
+				} else {
+					name = "/"
+				}
+			default:
+				if strings.Index(w, "/") >= 0 {
+					return errno(syscall.EINVAL)
+				}
+				name = join(name, w)
+			}
+			d, err := s.FS.Stat(name)
+			if err != nil {
+				if len(qids) == 0 {
+					return rerror(err)
+				}
+				break
+			}
+			qids = append(qids, d.Qid())
+		}
+		if len(qids) == len(t.Wname) {
+			s.setFid(t.Newfid, &sfid{name: name})
+		}
+		return &Fcall{Type: Rwalk, Wqid: qids}
+	case Tlopen:
+		if t.Flags&3 != syscall.O_RDONLY {
+			return errno(syscall.EROFS)
+		}
+		d, err := s.FS.Stat(f.name)
+		if err != nil {
+			return rerror(err)
+		}
+		var dir []Dir
+		var file File
+		if d.IsDir() {
+			dir, err = s.FS.ReadDir(f.name)
+		} else {
+			file, err = s.FS.Open(f.name)
+		}
+		if err != nil {
+			return rerror(err)
+		}
+		f.lock.Lock()
+		if f.open {
+			f.lock.Unlock()
+			if file != nil {
+				file.Close()
+			}
+			return errno(syscall.EBADF)
+		}
+		f.file, f.dir, f.open = file, dir, true
+		f.lock.Unlock()
+		return &Fcall{Type: Rlopen, Qid: d.Qid(), Iounit: s.Msize - IOHdrSz}
+	case Tgetattr:
+		d, err := s.FS.Stat(f.name)
+		if err != nil {
+			return rerror(err)
+		}
+		return &Fcall{Type: Rgetattr, Qid: d.Qid(), Attr: Attr{
+			Mode: d.Mode, Uid: d.Uid, Gid: d.Gid, Nlink: 1, Size: d.Size, Mtime: d.Mtime,
+		}}
+	case Tread:
+		f.lock.Lock()
+		file, xattr := f.file, f.xattr
+		f.lock.Unlock()
+		n := t.Count
+		if n > s.Msize-IOHdrSz {
+			n = s.Msize - IOHdrSz
+		}
+		if xattr != nil {
+			if t.Offset >= uint64(len(xattr)) {
+				return &Fcall{Type: Rread}
+			}
+			xattr = xattr[t.Offset:]
+			if uint64(len(xattr)) > uint64(n) {
+				xattr = xattr[:n]
+			}
+			return &Fcall{Type: Rread, Data: xattr}
+		}
+		if file == nil {
+			return errno(syscall.EBADF)
+		}
+		b := make([]byte, n)
+		/* a clunk at the same time closes it under us; that's the client's lookout */
+		m, err := file.ReadAt(b, int64(t.Offset))
+		if err != nil && err != os.EOF {
+			return rerror(err)
+		}
+		return &Fcall{Type: Rread, Data: b[:m]}
+	case Treaddir:
+		f.lock.Lock()
+		dir := f.dir
+		f.lock.Unlock()
+		if t.Offset > uint64(len(dir)) {
+			return &Fcall{Type: Rreaddir}
+		}
+		var ents []Dirent
+		for i, d := range dir[t.Offset:] {
+			q := d.Qid()
+			ents = append(ents, Dirent{Qid: q, Offset: t.Offset + uint64(i) + 1, Type: q.Type, Name: d.Name})
+		}
+		count := t.Count
+		if count > s.Msize-IOHdrSz {
+			count = s.Msize - IOHdrSz
+		}
+		return &Fcall{Type: Rreaddir, Data: Dirents(ents, count)}
+	case Treadlink:
+		target, err := s.FS.Readlink(f.name)
+		if err != nil {
+			return rerror(err)
+		}
+		return &Fcall{Type: Rreadlink, Target: target}
+	case Tclunk:
+		s.lock.Lock()
+		s.fids[t.Fid] = nil, false
+		s.lock.Unlock()
+		f.close()
+		return &Fcall{Type: Rclunk}
+	}
+	return errno(syscall.EOPNOTSUPP)
+}
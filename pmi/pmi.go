@@ -0,0 +1,146 @@
+// Package pmi is a client for the key-value service gproc provides to the
+// processes it launches, for parallel programs to exchange endpoint
+// addresses at startup. The service speaks the PMI-1 wire protocol over
+// a unix socket named by GPROC_PMI_SOCK.
+package pmi
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A Client is one process's connection to the key-value service
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	Rank    int
+	Size    int
+	Kvsname string
+}
+
+// Error is a failure reported by the key-value service
+type Error struct {
+	Cmd string
+	Rc  string
+	Msg string
+}
+
+func (e *Error) String() string {
+	return "pmi " + e.Cmd + ": rc=" + e.Rc + " " + e.Msg
+}
+
+// ParseCmd splits a protocol line into its key=value pairs. Values run
+// to the next space, except the last one on the line, which may have
+// spaces in it.
+func ParseCmd(line string) map[string]string {
+	m := make(map[string]string)
+	line = strings.TrimRight(line, "\r\n")
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			break
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+		end := strings.Index(line, " ")
+		if end < 0 || strings.Index(line[end:], "=") < 0 {
+			end = len(line)
+		}
+		m[key] = line[:end]
+		line = line[end:]
+	}
+	return m
+}
+
+// FormatCmd makes a protocol line from cmd and a list of keys and values
+func FormatCmd(cmd string, kv ...string) string {
+	s := "cmd=" + cmd
+	for i := 0; i+1 < len(kv); i += 2 {
+		s += " " + kv[i] + "=" + kv[i+1]
+	}
+	return s + "\n"
+}
+
+// Open connects to the key-value service for the job this process is part of
+func Open() (c *Client, err os.Error) {
+	sock := os.Getenv("GPROC_PMI_SOCK")
+	if sock == "" {
+		return nil, os.NewError("pmi: GPROC_PMI_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", "", sock)
+	if err != nil {
+		return
+	}
+	c = &Client{conn: conn, r: bufio.NewReader(conn)}
+	c.Rank, _ = strconv.Atoi(os.Getenv("GPROC_RANK"))
+	c.Size, _ = strconv.Atoi(os.Getenv("GPROC_SIZE"))
+	_, err = c.call("response_to_init", "init", "pmi_version", "1", "pmi_subversion", "1")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m, err := c.call("my_kvsname", "get_my_kvsname")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.Kvsname = m["kvsname"]
+	return
+}
+
+func (c *Client) call(want, cmd string, kv ...string) (m map[string]string, err os.Error) {
+	_, err = c.conn.Write([]byte(FormatCmd(cmd, kv...)))
+	if err != nil {
+		return
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	m = ParseCmd(line)
+	if m["cmd"] != want {
+		return nil, &Error{Cmd: cmd, Rc: "-1", Msg: "unexpected reply " + line}
+	}
+	if rc, ok := m["rc"]; ok && rc != "0" {
+		return nil, &Error{Cmd: cmd, Rc: rc, Msg: m["msg"]}
+	}
+	return
+}
+
+// Put stores value under key. Other processes can see it after the next Barrier.
+func (c *Client) Put(key, value string) (err os.Error) {
+	_, err = c.call("put_result", "put", "kvsname", c.Kvsname, "key", key, "value", value)
+	return
+}
+
+// Get returns the value stored under key
+func (c *Client) Get(key string) (value string, err os.Error) {
+	m, err := c.call("get_result", "get", "kvsname", c.Kvsname, "key", key)
+	if err != nil {
+		return
+	}
+	return m["value"], nil
+}
+
+// Barrier waits for every process in the job to reach the barrier, and
+// makes everything they Put before it visible to Get.
+func (c *Client) Barrier() (err os.Error) {
+	_, err = c.call("barrier_out", "barrier_in")
+	return
+}
+
+// Fence is Barrier under the name PMI-2 and PMIx use for it
+func (c *Client) Fence() os.Error {
+	return c.Barrier()
+}
+
+// Close tells the service this process is done and closes the connection
+func (c *Client) Close() (err os.Error) {
+	_, err = c.call("finalize_ack", "finalize")
+	c.conn.Close()
+	return
+}
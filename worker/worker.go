@@ -1,163 +1,455 @@
 // Package worker implements a set of abstract networked workers that can be
 // used to generalize typed network io between clients and workers
+//
+// Each Client and Worker is bound to the context it was made with. Every
+// call that blocks gives up when that context is done or when Close is
+// called, and returns an *Error saying which. Either way the connection
+// is torn down, and nothing the Client or Worker started is left running.
 package worker
 
 import (
-	"os"
+	"io"
+	"net"
 	"netchan"
+	"os"
+	"sync"
+
+	"gproc-npe.googlecode.com/hg/context"
 )
 
-// Data represents data sent from a client to a worker
+// ErrClosed is the Err of an Error from a call on a closed Client or Worker.
+var ErrClosed = os.NewError("use of closed connection")
+
+// Error is a call given up on: Err is ErrClosed, or the error of the
+// context the Client or Worker is bound to.
+type Error struct {
+	Op  string
+	Err os.Error
+}
+
+func (e *Error) String() string {
+	return "worker " + e.Op + ": " + e.Err.String()
+}
+
+// StartArg is what a client first tells a worker: what to run, and in
+// what environment.
+type StartArg struct {
+	Args []string
+	Env  []string
+	Node int
+}
+
+// Resp is a worker's answer to the client, when the work is done.
+type Resp struct {
+	Node   int
+	Status int
+	Msg    []byte
+}
+
+// Data represents data sent from a client to a worker. Data with nothing
+// in it marks the end.
 type Data struct {
-	node int
-	data []byte
+	Node int
+	Data []byte
 }
 
+// the channels a client and a worker share
+var chanNames = []string{"argChan", "dataChan", "respChan"}
+
 // A client is a work activator, distributing work to workers
 type Client struct {
 	achan chan StartArg
 	dchan chan Data
 	rchan chan Resp
+	node  int
+	buf   []byte // what Read has left over
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	imp    *netchan.Importer // a client's
+	exp    *netchan.Exporter // or a worker's
+	conn   io.Closer         // the client's connection or the worker's listener
+
+	// use is held for reading by the calls on the channels and for
+	// writing by teardown, so the channels aren't hung up under them
+	use  sync.RWMutex
+	hung bool
+
+	lock   sync.Mutex
+	closed bool
 }
 
-// NewClient creates a new client which connects to a worker at addr with
-// protocol fam. The initial arguments to push to the worker are included as
-// well
-func NewClient(fam, addr string, arg StartArg, nodeNum int) (client *Client, err os.Error) {
-	imp, err := netchan.Importer(fam, addr)
-	if err != nil {
+// bind ties c to ctx: when it is done, or c is closed, the calls
+// pending on c return and the connection is torn down.
+func (c *Client) bind(ctx context.Context, conn io.Closer) {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.conn = conn
+	go func() {
+		<-c.ctx.Done()
+		c.teardown()
+	}()
+}
+
+// teardown hangs up the channels and closes the connection, once, after
+// the calls using them have seen the context done and let go.
+func (c *Client) teardown() {
+	c.use.Lock()
+	defer c.use.Unlock()
+	if c.hung {
 		return
 	}
-	achan := make(chan StartArg)
-	err := imp.Import("argChan", achan, netchan.Send)
-	if err != nil {
+	c.hung = true
+	for _, name := range chanNames {
+		if c.imp != nil {
+			c.imp.Hangup(name)
+		} else {
+			c.exp.Hangup(name)
+		}
+	}
+	c.conn.Close()
+}
+
+// fail is the error for op given up on.
+func (c *Client) fail(op string) os.Error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || c.ctx.Err() == nil {
+		return &Error{Op: op, Err: ErrClosed}
+	}
+	return &Error{Op: op, Err: c.ctx.Err()}
+}
+
+// send puts d on the data channel.
+func (c *Client) send(op string, d Data) os.Error {
+	c.use.RLock()
+	defer c.use.RUnlock()
+	if c.hung {
+		return c.fail(op)
+	}
+	select {
+	case c.dchan <- d:
+		return nil
+	case <-c.ctx.Done():
+	}
+	return c.fail(op)
+}
+
+// recv takes the next Data off the data channel.
+func (c *Client) recv(op string) (d Data, err os.Error) {
+	c.use.RLock()
+	defer c.use.RUnlock()
+	if c.hung {
+		return d, c.fail(op)
+	}
+	select {
+	case d = <-c.dchan:
+		if closed(c.dchan) {
+			return d, c.fail(op)
+		}
 		return
+	case <-c.ctx.Done():
 	}
+	return d, c.fail(op)
+}
 
-	dchan := make(chan Data)
-	err := imp.Import("dataChan", dchan, netchan.Send)
+// NewClient creates a new client which connects to a worker at addr with
+// protocol fam. The initial arguments to push to the worker are included as
+// well, and are sent before NewClient returns unless ctx is done first.
+func NewClient(ctx context.Context, fam, addr string, arg StartArg, nodeNum int) (client *Client, err os.Error) {
+	conn, err := net.Dial(fam, "", addr)
 	if err != nil {
 		return
 	}
+	imp := netchan.NewImporter(conn)
+	achan := make(chan StartArg)
+	dchan := make(chan Data)
 	rchan := make(chan Resp)
-	err := imp.Import("respChan", rchan, netchan.Recv)
-	if err != nil {
+	for _, ch := range []struct {
+		name string
+		ch   interface{}
+		dir  netchan.Dir
+	}{
+		{"argChan", achan, netchan.Send},
+		{"dataChan", dchan, netchan.Send},
+		{"respChan", rchan, netchan.Recv},
+	} {
+		err = imp.Import(ch.name, ch.ch, ch.dir)
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+	c := &Client{achan: achan, dchan: dchan, rchan: rchan, node: nodeNum, imp: imp}
+	c.bind(ctx, conn)
+	arg.Node = nodeNum
+	select {
+	case achan <- arg:
+	case <-c.ctx.Done():
+		err = c.fail("start")
+		c.Close()
 		return
 	}
-	client = &Client{achan: achan, dchan: dchan, rchan: rchan}
+	client = c
 	return
 }
 
 // Write writes len(b) bytes to the File. It returns the number of bytes written
 // and an Error, if any. Write returns a non-nil Error when n != len(b).
-func (w *Client) Write(data []byte) (n int64, err os.Error) {
-	dchan <- &Data{nodeid: w.nodeid, data: data}
-	n = length(d.data)
-	if n <= 0 {
-		err = os.EOF
+func (c *Client) Write(data []byte) (n int, err os.Error) {
+	if len(data) == 0 {
+		// nothing in it would read as the end
 		return
 	}
-	return
+	err = c.send("write", Data{Node: c.node, Data: data})
+	if err != nil {
+		return
+	}
+	return len(data), nil
 }
 
-
-func (w *Client) ReadFrom(r io.Reader) (n int64, err os.Error) {
+// ReadFrom sends what it reads from r until EOF, and then the end. What
+// comes from a Worker is passed along as it came.
+func (c *Client) ReadFrom(r io.Reader) (n int64, err os.Error) {
 	if w, ok := r.(*Worker); ok {
 		for {
-			d := <-dchan
-			ndata := length(d.data)
-			if ndata <= 0 {
-				err = os.EOF
-				return
+			d, err := (*Client)(w).recv("readfrom")
+			if err != nil {
+				return n, err
 			}
-			n += ndata
-			w.dchan <- d
+			err = c.send("readfrom", d)
+			if err != nil || len(d.Data) == 0 {
+				return n, err
+			}
+			n += int64(len(d.Data))
 		}
-		return
 	}
+	buf := make([]byte, 32*1024)
 	for {
-		nread, err := r.Read(w.data)
-		n += ndata
-		if err != nil {
-			return
+		nread, rerr := r.Read(buf)
+		if nread > 0 {
+			_, err = c.Write(buf[:nread])
+			if err != nil {
+				return
+			}
+			n += int64(nread)
 		}
-		nwrite, err := w.Write()
-		if err != nil {
-			return
+		if rerr == os.EOF {
+			break
+		}
+		if rerr != nil {
+			return n, rerr
 		}
 	}
+	err = c.send("readfrom", Data{Node: c.node})
 	return
 }
 
-// A Worker is a work doer, it receives work from a client、
-type Worker Client
+// Resp waits for the worker's answer.
+func (c *Client) Resp() (r Resp, err os.Error) {
+	c.use.RLock()
+	defer c.use.RUnlock()
+	if c.hung {
+		return r, c.fail("resp")
+	}
+	select {
+	case r = <-c.rchan:
+		if closed(c.rchan) {
+			return r, c.fail("resp")
+		}
+		return
+	case <-c.ctx.Done():
+	}
+	return r, c.fail("resp")
+}
 
+// Close tears down the connection. Calls pending on c return an *Error
+// with ErrClosed, as do any made after.
+func (c *Client) Close() os.Error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return &Error{Op: "close", Err: ErrClosed}
+	}
+	c.closed = true
+	c.lock.Unlock()
+	c.cancel()
+	c.teardown()
+	return nil
+}
+
+// A Worker is a work doer, it receives work from a client
+type Worker Client
 
 // NewWorker creates a new worker which waits for a client connection at addr
 // with protocol fam.
-func NewWorker(fam, addr string) (worker *Worker, err os.Error) {
-	exp, err := netchan.Exporter(fam, addr)
+func NewWorker(ctx context.Context, fam, addr string) (worker *Worker, err os.Error) {
+	nl, err := net.Listen(fam, addr)
 	if err != nil {
 		return
 	}
+	l := &listener{Listener: nl}
+	exp := netchan.NewExporter()
 	achan := make(chan StartArg)
-	err := exp.Export("argChan", achan, netchan.Recv)
-	if err != nil {
-		return
-	}
 	dchan := make(chan Data)
-	err := exp.Export("dataChan", dchan, netchan.Recv)
-	if err != nil {
-		return
-	}
 	rchan := make(chan Resp)
-	err := exp.Export("respChan", rchan, netchan.Send)
+	for _, ch := range []struct {
+		name string
+		ch   interface{}
+		dir  netchan.Dir
+	}{
+		{"argChan", achan, netchan.Recv},
+		{"dataChan", dchan, netchan.Recv},
+		{"respChan", rchan, netchan.Send},
+	} {
+		err = exp.Export(ch.name, ch.ch, ch.dir)
+		if err != nil {
+			l.Close()
+			return
+		}
+	}
+	go exp.Serve(l)
+	c := &Client{achan: achan, dchan: dchan, rchan: rchan, exp: exp}
+	c.bind(ctx, l)
+	worker = (*Worker)(c)
+	return
+}
+
+// Addr is where the worker listens, for a client to connect to.
+func (w *Worker) Addr() net.Addr {
+	return w.conn.(net.Listener).Addr()
+}
+
+// listener remembers the connections it accepts, so that closing it
+// closes them as well, and not just the listening socket.
+type listener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+	done  bool
+}
+
+func (l *listener) Accept() (c net.Conn, err os.Error) {
+	c, err = l.Listener.Accept()
 	if err != nil {
 		return
 	}
-	worker = &Worker{achan: achan, dchan: dchan, rchan: rchan}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.done {
+		c.Close()
+		return nil, &Error{Op: "accept", Err: ErrClosed}
+	}
+	l.conns = append(l.conns, c)
 	return
 }
 
+func (l *listener) Close() os.Error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.done = true
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+	return l.Listener.Close()
+}
+
+// Arg waits for the client's StartArg.
+func (w *Worker) Arg() (arg StartArg, err os.Error) {
+	c := (*Client)(w)
+	c.use.RLock()
+	defer c.use.RUnlock()
+	if c.hung {
+		return arg, c.fail("arg")
+	}
+	select {
+	case arg = <-c.achan:
+		if closed(c.achan) {
+			return arg, c.fail("arg")
+		}
+		c.node = arg.Node
+		return
+	case <-c.ctx.Done():
+	}
+	return arg, c.fail("arg")
+}
+
+// Respond sends the client its answer.
+func (w *Worker) Respond(r Resp) os.Error {
+	c := (*Client)(w)
+	c.use.RLock()
+	defer c.use.RUnlock()
+	if c.hung {
+		return c.fail("respond")
+	}
+	r.Node = c.node
+	select {
+	case c.rchan <- r:
+		return nil
+	case <-c.ctx.Done():
+	}
+	return c.fail("respond")
+}
+
 // Read reads up to len(b) bytes from the File. It returns the number of bytes
 // read and an Error, if any. EOF is signaled by a zero count with err set to
 // EOF.
-func (w *Worker) Read(data []byte) (n int64, err os.Error) {
-	d := <-dchan
-	n = length(d.data)
-	if n <= 0 {
-		err = os.EOF
-		return
+func (w *Worker) Read(data []byte) (n int, err os.Error) {
+	c := (*Client)(w)
+	if len(c.buf) == 0 {
+		d, err := c.recv("read")
+		if err != nil {
+			return 0, err
+		}
+		if len(d.Data) == 0 {
+			return 0, os.EOF
+		}
+		c.buf = d.Data
 	}
-	data = d.data
+	n = copy(data, c.buf)
+	c.buf = c.buf[n:]
 	return
 }
 
-func (w *Worker) WriteTo(w io.Writer) (n int, err os.Error) {
-	if c, ok := w.(*Client); ok {
-		for {
-			d := <-dchan
-			ndata := length(d.data)
-			if ndata <= 0 {
-				err = os.EOF
-				return
-			}
-			n += ndata
-			w.dchan <- d
+// WriteTo writes what comes from the client to dst until it ends. To a
+// Client it is passed along as it came, the end included.
+func (w *Worker) WriteTo(dst io.Writer) (n int64, err os.Error) {
+	c := (*Client)(w)
+	if len(c.buf) > 0 {
+		nw, err := dst.Write(c.buf)
+		n += int64(nw)
+		c.buf = c.buf[nw:]
+		if err != nil {
+			return n, err
 		}
-		return
 	}
+	to, relay := dst.(*Client)
 	for {
-		d := <-dchan
-		rn = length(d.data)
-		if rn <= 0 {
-			err = os.EOF
-			return
+		d, err := c.recv("writeto")
+		if err != nil {
+			return n, err
+		}
+		if relay {
+			err = to.send("writeto", d)
+			if err != nil || len(d.Data) == 0 {
+				return n, err
+			}
+			n += int64(len(d.Data))
+			continue
+		}
+		if len(d.Data) == 0 {
+			return n, nil
 		}
-		n, err = w.Write(d.data)
+		nw, err := dst.Write(d.Data)
+		n += int64(nw)
 		if err != nil {
-			return
+			return n, err
 		}
 	}
 	return
 }
+
+// Close tears down the connection, as for Client.
+func (w *Worker) Close() os.Error {
+	return (*Client)(w).Close()
+}
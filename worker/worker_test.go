@@ -0,0 +1,173 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"gproc-npe.googlecode.com/hg/context"
+)
+
+// pair makes a worker on the loopback and a client connected to it.
+func pair(t *testing.T, ctx context.Context) (c *Client, w *Worker) {
+	w, err := NewWorker(ctx, "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewWorker: %v", err)
+	}
+	done := make(chan os.Error)
+	go func() {
+		var err os.Error
+		c, err = NewClient(ctx, "tcp4", w.Addr().String(), StartArg{Args: []string{"cat"}}, 3)
+		done <- err
+	}()
+	arg, err := w.Arg()
+	if err != nil {
+		t.Fatalf("Arg: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if len(arg.Args) != 1 || arg.Args[0] != "cat" || arg.Node != 3 {
+		t.Fatalf("Arg: got %+v", arg)
+	}
+	return
+}
+
+// settle waits for the goroutines to get back down to n, and fails if
+// they don't.
+func settle(t *testing.T, n int32) {
+	for i := 0; i < 100; i++ {
+		if runtime.Goroutines() <= n {
+			return
+		}
+		time.Sleep(10e6)
+	}
+	t.Errorf("%d goroutines left running, want %d", runtime.Goroutines(), n)
+}
+
+// pending runs f, which should block, and gives back what it returns.
+func pending(f func() os.Error) chan os.Error {
+	ch := make(chan os.Error, 1)
+	go func() { ch <- f() }()
+	time.Sleep(50e6)
+	return ch
+}
+
+func wantErr(t *testing.T, ch chan os.Error, want os.Error) {
+	select {
+	case err := <-ch:
+		e, ok := err.(*Error)
+		if !ok || e.Err != want {
+			t.Errorf("got %v, want a worker.Error with %v", err, want)
+		}
+	case <-time.After(5e9):
+		t.Errorf("still blocked, want %v", want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	n := runtime.Goroutines()
+	c, w := pair(t, context.Background())
+	msg := strings.Repeat("some data ", 10000)
+	go func() {
+		if _, err := c.ReadFrom(strings.NewReader(msg)); err != nil {
+			t.Errorf("ReadFrom: %v", err)
+		}
+	}()
+	b, err := ioutil.ReadAll(w)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(b) != msg {
+		t.Errorf("got %d bytes, want %d", len(b), len(msg))
+	}
+	go w.Respond(Resp{Status: 7})
+	r, err := c.Resp()
+	if err != nil || r.Status != 7 || r.Node != 3 {
+		t.Errorf("Resp: got %+v, %v", r, err)
+	}
+	c.Close()
+	w.Close()
+	settle(t, n)
+}
+
+func TestWriteTo(t *testing.T) {
+	n := runtime.Goroutines()
+	c, w := pair(t, context.Background())
+	go func() {
+		c.Write([]byte("hello, "))
+		c.Write([]byte("world"))
+		c.ReadFrom(strings.NewReader(""))
+	}()
+	var b bytes.Buffer
+	_, err := w.WriteTo(&b)
+	if err != nil || b.String() != "hello, world" {
+		t.Errorf("WriteTo: got %q, %v", b.String(), err)
+	}
+	c.Close()
+	w.Close()
+	settle(t, n)
+}
+
+func TestCloseUnblocks(t *testing.T) {
+	n := runtime.Goroutines()
+	c, w := pair(t, context.Background())
+	read := pending(func() os.Error {
+		_, err := w.Read(make([]byte, 10))
+		return err
+	})
+	resp := pending(func() os.Error {
+		_, err := c.Resp()
+		return err
+	})
+	w.Close()
+	wantErr(t, read, ErrClosed)
+	c.Close()
+	wantErr(t, resp, ErrClosed)
+
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Error("Write after Close worked")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("second Close worked")
+	}
+	settle(t, n)
+}
+
+func TestCancelUnblocks(t *testing.T) {
+	n := runtime.Goroutines()
+	ctx, cancel := context.WithCancel(context.Background())
+	c, w := pair(t, ctx)
+	read := pending(func() os.Error {
+		_, err := w.WriteTo(ioutil.Discard)
+		return err
+	})
+	resp := pending(func() os.Error {
+		_, err := c.Resp()
+		return err
+	})
+	cancel()
+	wantErr(t, read, context.Canceled)
+	wantErr(t, resp, context.Canceled)
+	settle(t, n)
+}
+
+func TestTimeout(t *testing.T) {
+	n := runtime.Goroutines()
+	ctx, cancel := context.WithTimeout(context.Background(), 100e6)
+	defer cancel()
+	w, err := NewWorker(ctx, "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewWorker: %v", err)
+	}
+	// no client ever comes
+	wantErr(t, pending(func() os.Error {
+		_, err := w.Arg()
+		return err
+	}), context.DeadlineExceeded)
+	settle(t, n)
+}